@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errUnauthenticated is returned by an authenticator if the request could not be authenticated.
+	errUnauthenticated = errors.New("unauthenticated")
+	// errForbidden is returned by an authenticator if the request was authenticated but is not allowed.
+	errForbidden = errors.New("forbidden")
+)
+
+// tenant is an authenticated consumer of the filterproxy.
+type tenant struct {
+	name string
+	// matchers are always applied to the metrics served to the tenant.
+	matchers matcherSet
+	// endpoints are the names of the endpoints the tenant has access to. If nil, the tenant has access to all endpoints.
+	endpoints map[string]bool
+}
+
+func (t *tenant) canAccess(endpoint string) bool {
+	return t.endpoints == nil || t.endpoints[endpoint]
+}
+
+type authenticator interface {
+	// Authenticate returns the tenant that sent the request.
+	// It returns errUnauthenticated if the request could not be authenticated.
+	Authenticate(r *http.Request) (*tenant, error)
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantFrom returns the tenant of the context, or nil if the request was not authenticated.
+func tenantFrom(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
+
+// tenantMatchers returns the matchers that need to be enforced for the tenant of the context.
+func tenantMatchers(ctx context.Context) matcherSet {
+	t := tenantFrom(ctx)
+	if t == nil {
+		return nil
+	}
+	return t.matchers
+}
+
+// authenticate returns a handler that authenticates every request before passing it to next.
+// The authenticated tenant is stored in the request context.
+// If endpoint is not empty, the tenant needs to have access to the endpoint with that name.
+// If auth is nil, all requests are passed through unauthenticated.
+func authenticate(endpoint string, auth authenticator, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := auth.Authenticate(r)
+		switch {
+		case errors.Is(err, errUnauthenticated):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="exporter-filterproxy"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		case errors.Is(err, errForbidden):
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("Failed to authenticate request: %s", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if endpoint != "" && !t.canAccess(endpoint) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+	})
+}
+
+// multiAuthenticator tries to authenticate a request with all its authenticators in order.
+// The first authenticator that does not return errUnauthenticated decides the outcome.
+type multiAuthenticator []authenticator
+
+func (ma multiAuthenticator) Authenticate(r *http.Request) (*tenant, error) {
+	for _, a := range ma {
+		t, err := a.Authenticate(r)
+		if errors.Is(err, errUnauthenticated) {
+			continue
+		}
+		return t, err
+	}
+	return nil, errUnauthenticated
+}
+
+// tokenAuthenticator authenticates requests using static bearer tokens.
+type tokenAuthenticator struct {
+	tokens map[string]*tenant
+}
+
+func newTokenAuthenticator(tenants map[string]tenantConfig) (*tokenAuthenticator, error) {
+	a := &tokenAuthenticator{
+		tokens: map[string]*tenant{},
+	}
+	for name, tc := range tenants {
+		if tc.Token == "" {
+			return nil, fmt.Errorf("tenant %q has no token", name)
+		}
+		if _, ok := a.tokens[tc.Token]; ok {
+			return nil, fmt.Errorf("tenant %q uses the same token as another tenant", name)
+		}
+		t, err := tc.tenant(name)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens[tc.Token] = t
+	}
+	return a, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*tenant, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	// Compare all tokens in constant time to not leak them through timing
+	var res *tenant
+	for t, tenant := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			res = tenant
+		}
+	}
+	if res == nil {
+		return nil, errUnauthenticated
+	}
+	return res, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
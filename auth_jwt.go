@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// jwtAuthenticator authenticates requests using JWTs signed by one of the keys of a JSON Web Key Set.
+// The values of a configurable claim are mapped onto a label matcher that is enforced for the caller.
+type jwtAuthenticator struct {
+	keys *jwksCache
+
+	issuer   string
+	audience string
+	claim    string
+	label    string
+
+	clock func() time.Time
+}
+
+func newJWTAuthenticator(conf jwtAuthConfig) (*jwtAuthenticator, error) {
+	if (conf.JWKSFile == "") == (conf.JWKSURL == "") {
+		return nil, errors.New("exactly one of jwks_file or jwks_url needs to be set")
+	}
+	if conf.Claim == "" || conf.Label == "" {
+		return nil, errors.New("claim and label need to be set")
+	}
+	// Otherwise any token signed by the key set would be accepted, including tokens issued for other services
+	if conf.Issuer == "" || conf.Audience == "" {
+		return nil, errors.New("issuer and audience need to be set")
+	}
+	refreshInterval := conf.JWKSRefreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = time.Hour
+	}
+	a := &jwtAuthenticator{
+		keys: &jwksCache{
+			file:            conf.JWKSFile,
+			url:             conf.JWKSURL,
+			refreshInterval: refreshInterval,
+			client: &http.Client{
+				Timeout: 5 * time.Second,
+			},
+		},
+		issuer:   conf.Issuer,
+		audience: conf.Audience,
+		claim:    conf.Claim,
+		label:    conf.Label,
+	}
+	a.keys.clock = a.now
+	return a, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*tenant, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	tok, err := jwt.ParseSigned(token)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, errUnauthenticated
+	}
+
+	keys, err := a.keys.Get(tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load JWKS: %w", err)
+	}
+
+	std := jwt.Claims{}
+	custom := map[string]interface{}{}
+	verified := false
+	for _, key := range keys {
+		if key.Algorithm != "" && key.Algorithm != tok.Headers[0].Algorithm {
+			continue
+		}
+		// Only public keys are accepted, so that tokens can't be signed using a symmetric key from the key set
+		pub := key.Public()
+		if !pub.Valid() {
+			continue
+		}
+		if err := tok.Claims(pub.Key, &std, &custom); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errUnauthenticated
+	}
+
+	// ValidateWithLeeway only checks the expiry if it is set, but tokens that never expire must not be accepted
+	if std.Expiry == nil {
+		return nil, errUnauthenticated
+	}
+	expected := jwt.Expected{
+		Issuer:   a.issuer,
+		Audience: jwt.Audience{a.audience},
+		Time:     a.now(),
+	}
+	if err := std.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return nil, errUnauthenticated
+	}
+
+	values := claimValues(custom[a.claim])
+	if len(values) == 0 {
+		return nil, errForbidden
+	}
+	m, err := newSetMatcher(a.label, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenant{
+		name:     std.Subject,
+		matchers: matcherSet{m},
+	}, nil
+}
+
+func (a *jwtAuthenticator) now() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+	return time.Now()
+}
+
+// claimValues returns the non-empty string values of a claim that is either a string or a list of strings.
+func claimValues(claim interface{}) []string {
+	values := []string{}
+	switch c := claim.(type) {
+	case string:
+		if c != "" {
+			values = append(values, c)
+		}
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// jwksCache loads a JSON Web Key Set from a file or URL and refreshes it every refreshInterval,
+// or earlier if a token references an unknown key.
+// The key set is loaded without holding the mutex, so that requests with known keys are not blocked by a slow refresh.
+type jwksCache struct {
+	file string
+	url  string
+
+	client *http.Client
+
+	clock           func() time.Time
+	refreshInterval time.Duration
+	mutex           sync.Mutex
+	keys            *jose.JSONWebKeySet
+	lastUpdated     time.Time
+	lastAttempt     time.Time
+	lastErr         error
+	// refreshing is closed once the running refresh is done. It is nil if no refresh is running.
+	refreshing chan struct{}
+}
+
+// minJWKSRefreshInterval limits how often the key set is loaded if it could not be loaded or a token references an unknown key.
+const minJWKSRefreshInterval = 10 * time.Second
+
+// Get returns the keys with the given key ID, or all keys if kid is empty.
+// If the key set is outdated, it's refreshed in the background and the cached keys are returned.
+// Only if the key is unknown, Get waits for the key set to be refreshed.
+func (c *jwksCache) Get(kid string) ([]jose.JSONWebKey, error) {
+	c.mutex.Lock()
+	if keys := c.find(kid); len(keys) > 0 {
+		if c.clock().Sub(c.lastUpdated) >= c.refreshInterval {
+			c.startRefresh()
+		}
+		c.mutex.Unlock()
+		return keys, nil
+	}
+	done := c.startRefresh()
+	c.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.keys == nil {
+		return nil, c.lastErr
+	}
+	return c.find(kid), nil
+}
+
+func (c *jwksCache) find(kid string) []jose.JSONWebKey {
+	if c.keys == nil {
+		return nil
+	}
+	if kid == "" {
+		return c.keys.Keys
+	}
+	return c.keys.Key(kid)
+}
+
+// startRefresh starts reloading the key set in the background, unless the last attempt was less than
+// minJWKSRefreshInterval ago. It returns a channel that is closed once the running refresh is done,
+// or nil if no refresh is running. If loading fails, the previous key set is kept.
+// The mutex needs to be held by the caller.
+func (c *jwksCache) startRefresh() <-chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+	now := c.clock()
+	if !c.lastAttempt.IsZero() && now.Sub(c.lastAttempt) < minJWKSRefreshInterval {
+		return nil
+	}
+	c.lastAttempt = now
+	done := make(chan struct{})
+	c.refreshing = done
+
+	go func() {
+		defer close(done)
+		keys, err := c.fetch()
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.refreshing = nil
+		c.lastErr = err
+		if err != nil {
+			log.Printf("Failed to load JWKS: %s", err.Error())
+			return
+		}
+		c.keys = keys
+		c.lastUpdated = now
+	}()
+	return done
+}
+
+func (c *jwksCache) fetch() (*jose.JSONWebKeySet, error) {
+	raw, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	keys := &jose.JSONWebKeySet{}
+	if err := json.Unmarshal(raw, keys); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	return keys, nil
+}
+
+func (c *jwksCache) load() ([]byte, error) {
+	if c.file != "" {
+		return os.ReadFile(c.file)
+	}
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d when fetching JWKS", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := newTestJWK(t, "key-1")
+	otherKey := newTestJWK(t, "key-1")
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeTestJWKS(t, jwksFile, key)
+
+	auth, err := newJWTAuthenticator(jwtAuthConfig{
+		JWKSFile: jwksFile,
+		Issuer:   "https://issuer.example.com",
+		Audience: "filterproxy",
+		Claim:    "namespaces",
+		Label:    "namespace",
+	})
+	require.NoError(t, err)
+	h := authenticate("test", auth, multiHandler("/test", testMultiMetricsFetcher, nil))
+
+	now := time.Now()
+	validClaims := jwt.Claims{
+		Subject:  "team-b",
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"filterproxy"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+
+	tcs := map[string]struct {
+		token string
+
+		code int
+		body string
+	}{
+		"NoToken": {
+			code: http.StatusUnauthorized,
+		},
+		"NotAJWT": {
+			token: "foo",
+			code:  http.StatusUnauthorized,
+		},
+		"Valid": {
+			token: signTestJWT(t, key, validClaims, map[string]interface{}{"namespaces": []string{"b"}}),
+			code:  http.StatusOK,
+			body:  expectedKubeAuthB,
+		},
+		"ValidMultiple": {
+			token: signTestJWT(t, key, validClaims, map[string]interface{}{"namespaces": []string{"b", "shared"}}),
+			code:  http.StatusOK,
+			body:  expectedKubeAuthBShared,
+		},
+		"ValidString": {
+			token: signTestJWT(t, key, validClaims, map[string]interface{}{"namespaces": "b"}),
+			code:  http.StatusOK,
+			body:  expectedKubeAuthB,
+		},
+		"MissingClaim": {
+			token: signTestJWT(t, key, validClaims, map[string]interface{}{"groups": []string{"b"}}),
+			code:  http.StatusForbidden,
+		},
+		"WrongKey": {
+			token: signTestJWT(t, otherKey, validClaims, map[string]interface{}{"namespaces": []string{"b"}}),
+			code:  http.StatusUnauthorized,
+		},
+		"Expired": {
+			token: signTestJWT(t, key, jwt.Claims{
+				Subject:  "team-b",
+				Issuer:   "https://issuer.example.com",
+				Audience: jwt.Audience{"filterproxy"},
+				Expiry:   jwt.NewNumericDate(now.Add(-time.Hour)),
+			}, map[string]interface{}{"namespaces": []string{"b"}}),
+			code: http.StatusUnauthorized,
+		},
+		"WrongIssuer": {
+			token: signTestJWT(t, key, jwt.Claims{
+				Subject:  "team-b",
+				Issuer:   "https://other.example.com",
+				Audience: jwt.Audience{"filterproxy"},
+				Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			}, map[string]interface{}{"namespaces": []string{"b"}}),
+			code: http.StatusUnauthorized,
+		},
+		"NoExpiry": {
+			token: signTestJWT(t, key, jwt.Claims{
+				Subject:  "team-b",
+				Issuer:   "https://issuer.example.com",
+				Audience: jwt.Audience{"filterproxy"},
+			}, map[string]interface{}{"namespaces": []string{"b"}}),
+			code: http.StatusUnauthorized,
+		},
+		"NoAudience": {
+			token: signTestJWT(t, key, jwt.Claims{
+				Subject: "team-b",
+				Issuer:  "https://issuer.example.com",
+				Expiry:  jwt.NewNumericDate(now.Add(time.Hour)),
+			}, map[string]interface{}{"namespaces": []string{"b"}}),
+			code: http.StatusUnauthorized,
+		},
+		"WrongAudience": {
+			token: signTestJWT(t, key, jwt.Claims{
+				Subject:  "team-b",
+				Issuer:   "https://issuer.example.com",
+				Audience: jwt.Audience{"other"},
+				Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+			}, map[string]interface{}{"namespaces": []string{"b"}}),
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/test/ns", nil)
+			require.NoError(t, err)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewJWTAuthenticator_Invalid(t *testing.T) {
+	_, err := newJWTAuthenticator(jwtAuthConfig{
+		JWKSFile: "jwks.json",
+		Issuer:   "https://issuer.example.com",
+		Claim:    "namespaces",
+		Label:    "namespace",
+	})
+	assert.Error(t, err, "tokens issued for any audience must not be accepted")
+}
+
+func TestJWTAuthenticator_URLRotation(t *testing.T) {
+	oldKey := newTestJWK(t, "old")
+	newKey := newTestJWK(t, "new")
+
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{oldKey.Public()}}
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		require.NoError(t, json.NewEncoder(rw).Encode(jwks))
+	}))
+	defer server.Close()
+
+	fakeNow := time.Now()
+	auth, err := newJWTAuthenticator(jwtAuthConfig{
+		JWKSURL:  server.URL,
+		Issuer:   "https://issuer.example.com",
+		Audience: "filterproxy",
+		Claim:    "namespaces",
+		Label:    "namespace",
+	})
+	require.NoError(t, err)
+	auth.clock = func() time.Time {
+		return fakeNow
+	}
+
+	claims := jwt.Claims{
+		Subject:  "team-b",
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"filterproxy"},
+		Expiry:   jwt.NewNumericDate(fakeNow.Add(time.Hour)),
+	}
+	authenticate := func(key jose.JSONWebKey) error {
+		req, err := http.NewRequest("GET", "/test/ns", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+signTestJWT(t, key, claims, map[string]interface{}{"namespaces": "b"}))
+		_, err = auth.Authenticate(req)
+		return err
+	}
+
+	require.NoError(t, authenticate(oldKey))
+	require.NoError(t, authenticate(oldKey))
+	assert.Equal(t, 1, calls)
+
+	// Unknown keys trigger a refresh, but not more often than minJWKSRefreshInterval
+	jwks = jose.JSONWebKeySet{Keys: []jose.JSONWebKey{newKey.Public()}}
+	assert.ErrorIs(t, authenticate(newKey), errUnauthenticated)
+	assert.Equal(t, 1, calls)
+
+	fakeNow = fakeNow.Add(minJWKSRefreshInterval)
+	require.NoError(t, authenticate(newKey))
+	assert.Equal(t, 2, calls)
+}
+
+func TestJWTAuthenticator_SlowRefresh(t *testing.T) {
+	key := newTestJWK(t, "key")
+
+	// block is closed to let the refreshes after the first request continue
+	block := make(chan struct{})
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls > 1 {
+			<-block
+		}
+		require.NoError(t, json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}}))
+	}))
+	defer server.Close()
+	defer close(block)
+
+	fakeNow := time.Now()
+	auth, err := newJWTAuthenticator(jwtAuthConfig{
+		JWKSURL:  server.URL,
+		Issuer:   "https://issuer.example.com",
+		Audience: "filterproxy",
+		Claim:    "namespaces",
+		Label:    "namespace",
+	})
+	require.NoError(t, err)
+	auth.clock = func() time.Time {
+		return fakeNow
+	}
+	claims := jwt.Claims{
+		Subject:  "team-b",
+		Issuer:   "https://issuer.example.com",
+		Audience: jwt.Audience{"filterproxy"},
+		Expiry:   jwt.NewNumericDate(fakeNow.Add(3 * time.Hour)),
+	}
+	req, err := http.NewRequest("GET", "/test/ns", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+signTestJWT(t, key, claims, map[string]interface{}{"namespaces": "b"}))
+
+	_, err = auth.Authenticate(req)
+	require.NoError(t, err)
+
+	// The key set is outdated and its refresh blocks, but the cached keys are still used
+	fakeNow = fakeNow.Add(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		done := make(chan error)
+		go func() {
+			_, err := auth.Authenticate(req)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("request was blocked by the refresh of the key set")
+		}
+	}
+}
+
+func newTestJWK(t *testing.T, kid string) jose.JSONWebKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return jose.JSONWebKey{
+		Key:       key,
+		KeyID:     kid,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}
+}
+
+func writeTestJWKS(t *testing.T, path string, keys ...jose.JSONWebKey) {
+	jwks := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		jwks.Keys = append(jwks.Keys, k.Public())
+	}
+	raw, err := json.Marshal(jwks)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, raw, 0o600))
+}
+
+func signTestJWT(t *testing.T, key jose.JSONWebKey, claims jwt.Claims, custom map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).Claims(custom).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
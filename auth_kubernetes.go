@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// kubeAuthenticator authenticates requests using Kubernetes TokenReviews and authorizes them using SubjectAccessReviews.
+// A request needs to select one or more namespaces using an equality matcher on the namespace label, for example `?namespace=foo`.
+// Requests that don't select a namespace, including requests for the service discovery, are always forbidden.
+// The caller is only allowed to access the metrics if it is allowed to access the configured resource in all requested namespaces.
+type kubeAuthenticator struct {
+	kube client.Client
+
+	namespaceLabel string
+	verb           string
+	group          string
+	resource       string
+	audiences      []string
+
+	clock    func() time.Time
+	cacheTTL time.Duration
+	mutex    sync.Mutex
+	cache    map[string]kubeAuthResult
+}
+
+type kubeAuthResult struct {
+	tenant    *tenant
+	err       error
+	expiresAt time.Time
+}
+
+func newKubeAuthenticator(kube client.Client, conf kubeAuthConfig) *kubeAuthenticator {
+	a := &kubeAuthenticator{
+		kube:           kube,
+		namespaceLabel: conf.NamespaceLabel,
+		verb:           conf.Verb,
+		group:          conf.Group,
+		resource:       conf.Resource,
+		audiences:      conf.Audiences,
+		cacheTTL:       conf.CacheTTL,
+		cache:          map[string]kubeAuthResult{},
+	}
+	if a.namespaceLabel == "" {
+		a.namespaceLabel = "namespace"
+	}
+	if a.verb == "" {
+		a.verb = "get"
+	}
+	if a.resource == "" {
+		a.resource = "pods"
+	}
+	return a
+}
+
+func (a *kubeAuthenticator) Authenticate(r *http.Request) (*tenant, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	namespaces := a.requestedNamespaces(r)
+
+	key := fmt.Sprintf("%x/%s", sha256.Sum256([]byte(token)), strings.Join(namespaces, ","))
+	a.mutex.Lock()
+	cached, ok := a.cache[key]
+	a.mutex.Unlock()
+	if ok && a.now().Before(cached.expiresAt) {
+		return cached.tenant, cached.err
+	}
+
+	t, err := a.authenticate(r.Context(), token, namespaces)
+	if err == nil || errors.Is(err, errUnauthenticated) || errors.Is(err, errForbidden) {
+		a.mutex.Lock()
+		a.evictExpired()
+		a.cache[key] = kubeAuthResult{
+			tenant:    t,
+			err:       err,
+			expiresAt: a.now().Add(a.cacheTTL),
+		}
+		a.mutex.Unlock()
+	}
+	return t, err
+}
+
+func (a *kubeAuthenticator) authenticate(ctx context.Context, token string, namespaces []string) (*tenant, error) {
+	tr := &authnv1.TokenReview{
+		Spec: authnv1.TokenReviewSpec{
+			Token:     token,
+			Audiences: a.audiences,
+		},
+	}
+	if err := a.kube.Create(ctx, tr); err != nil {
+		return nil, fmt.Errorf("failed to create TokenReview: %w", err)
+	}
+	if !tr.Status.Authenticated {
+		return nil, errUnauthenticated
+	}
+	// The API server only returns the audiences the token is valid for. If none of them was requested,
+	// the authenticator doesn't support audiences and the token can't be trusted.
+	if len(a.audiences) > 0 && !containsAny(tr.Status.Audiences, a.audiences) {
+		return nil, errUnauthenticated
+	}
+	if len(namespaces) == 0 {
+		return nil, errForbidden
+	}
+
+	user := tr.Status.User
+	extra := map[string]authzv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authzv1.ExtraValue(v)
+	}
+	for _, ns := range namespaces {
+		sar := &authzv1.SubjectAccessReview{
+			Spec: authzv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				ResourceAttributes: &authzv1.ResourceAttributes{
+					Namespace: ns,
+					Verb:      a.verb,
+					Group:     a.group,
+					Resource:  a.resource,
+				},
+			},
+		}
+		if err := a.kube.Create(ctx, sar); err != nil {
+			return nil, fmt.Errorf("failed to create SubjectAccessReview: %w", err)
+		}
+		if !sar.Status.Allowed {
+			return nil, errForbidden
+		}
+	}
+
+	m, err := newSetMatcher(a.namespaceLabel, namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenant{
+		name:     user.Username,
+		matchers: matcherSet{m},
+	}, nil
+}
+
+// requestedNamespaces returns the sorted namespaces the request selects using equality matchers on the namespace label.
+func (a *kubeAuthenticator) requestedNamespaces(r *http.Request) []string {
+	namespaces := []string{}
+	for _, v := range r.URL.Query()[a.namespaceLabel] {
+		m, err := parseMatcherParam(a.namespaceLabel, v)
+		if err != nil || m.Type != matchEqual || m.Value == "" {
+			continue
+		}
+		namespaces = append(namespaces, m.Value)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func containsAny(values []string, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *kubeAuthenticator) evictExpired() {
+	now := a.now()
+	for k, v := range a.cache {
+		if !now.Before(v.expiresAt) {
+			delete(a.cache, k)
+		}
+	}
+}
+
+func (a *kubeAuthenticator) now() time.Time {
+	if a.clock != nil {
+		return a.clock()
+	}
+	return time.Now()
+}
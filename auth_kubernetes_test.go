@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestKubeAuthenticator(t *testing.T) {
+	kube := &fakeReviewClient{
+		Client: newTestKubeClient(),
+		users: map[string]string{
+			"a-token": "system:serviceaccount:a:prometheus",
+			"b-token": "system:serviceaccount:b:prometheus",
+		},
+		access: map[string][]string{
+			"system:serviceaccount:a:prometheus": {"a", "shared"},
+			"system:serviceaccount:b:prometheus": {"b", "shared"},
+		},
+	}
+	auth := newKubeAuthenticator(kube, kubeAuthConfig{})
+	h := authenticate("test", auth, multiHandler("/test", testMultiMetricsFetcher, nil))
+
+	tcs := map[string]struct {
+		token string
+		query string
+
+		code int
+		body string
+	}{
+		"NoToken": {
+			query: "?foo=buzz",
+			code:  http.StatusUnauthorized,
+		},
+		"InvalidToken": {
+			token: "c-token",
+			query: "?foo=buzz",
+			code:  http.StatusUnauthorized,
+		},
+		"NoNamespace": {
+			token: "a-token",
+			query: "?foo=buzz",
+			code:  http.StatusForbidden,
+		},
+		"RegexpNamespace": {
+			token: "a-token",
+			query: "?namespace=~.*",
+			code:  http.StatusForbidden,
+		},
+		"OtherNamespace": {
+			token: "a-token",
+			query: "?namespace=b",
+			code:  http.StatusForbidden,
+		},
+		"PartialAccess": {
+			token: "a-token",
+			query: "?namespace=a&namespace=b",
+			code:  http.StatusForbidden,
+		},
+		"Allowed": {
+			token: "b-token",
+			query: "?namespace=b",
+			code:  http.StatusOK,
+			body:  expectedKubeAuthB,
+		},
+		"AllowedMultiple": {
+			token: "b-token",
+			query: "?namespace=b&namespace=shared",
+			code:  http.StatusOK,
+			body:  expectedKubeAuthBShared,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/test/ns"+tc.query, nil)
+			require.NoError(t, err)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, rr.Body.String())
+			}
+		})
+	}
+}
+
+var expectedKubeAuthB = `# HELP ns NS
+# TYPE ns gauge
+ns{namespace="b"} 2
+`
+var expectedKubeAuthBShared = `# HELP ns NS
+# TYPE ns gauge
+ns{namespace="b"} 2
+ns{namespace="shared"} 3
+`
+
+func TestKubeAuthenticator_Cache(t *testing.T) {
+	kube := &fakeReviewClient{
+		Client: newTestKubeClient(),
+		users: map[string]string{
+			"a-token": "system:serviceaccount:a:prometheus",
+		},
+		access: map[string][]string{
+			"system:serviceaccount:a:prometheus": {"a"},
+		},
+	}
+	fakeNow := time.Now()
+	auth := newKubeAuthenticator(kube, kubeAuthConfig{CacheTTL: time.Minute})
+	auth.clock = func() time.Time {
+		return fakeNow
+	}
+
+	req, err := http.NewRequest("GET", "/test/ns?namespace=a", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer a-token")
+
+	for i := 0; i < 3; i++ {
+		tenant, err := auth.Authenticate(req)
+		require.NoError(t, err)
+		assert.Equal(t, "system:serviceaccount:a:prometheus", tenant.name)
+		assert.Equal(t, `{namespace="a"}`, tenant.matchers.String())
+	}
+	assert.Equal(t, 2, kube.calls)
+
+	fakeNow = fakeNow.Add(2 * time.Minute)
+	_, err = auth.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, 4, kube.calls)
+}
+
+func TestKubeAuthenticator_Audiences(t *testing.T) {
+	kube := &fakeReviewClient{
+		Client: newTestKubeClient(),
+		users: map[string]string{
+			"api-token":   "system:serviceaccount:a:prometheus",
+			"proxy-token": "system:serviceaccount:a:prometheus",
+		},
+		access: map[string][]string{
+			"system:serviceaccount:a:prometheus": {"a"},
+		},
+		audiences: map[string][]string{
+			"proxy-token": {"exporter-filterproxy"},
+		},
+	}
+
+	req, err := http.NewRequest("GET", "/test/ns?namespace=a", nil)
+	require.NoError(t, err)
+
+	auth := newKubeAuthenticator(kube, kubeAuthConfig{Audiences: []string{"exporter-filterproxy"}})
+	req.Header.Set("Authorization", "Bearer proxy-token")
+	_, err = auth.Authenticate(req)
+	require.NoError(t, err)
+
+	req.Header.Set("Authorization", "Bearer api-token")
+	_, err = auth.Authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated, "tokens issued for other audiences must be rejected")
+}
+
+// fakeReviewClient answers TokenReviews and SubjectAccessReviews from static maps.
+type fakeReviewClient struct {
+	client.Client
+	// users maps tokens to user names
+	users map[string]string
+	// access maps user names to the namespaces they have access to
+	access map[string][]string
+	// audiences maps tokens to the audiences they were issued for. Defaults to the audience of the API server.
+	audiences map[string][]string
+
+	calls int
+}
+
+func (c *fakeReviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.calls++
+	switch o := obj.(type) {
+	case *authnv1.TokenReview:
+		user, ok := c.users[o.Spec.Token]
+		audiences, found := c.audiences[o.Spec.Token]
+		if !found {
+			audiences = []string{"https://kubernetes.default.svc"}
+		}
+		if len(o.Spec.Audiences) > 0 {
+			// Like the API server, only return the requested audiences the token is valid for
+			valid := []string{}
+			for _, a := range audiences {
+				if containsAny(o.Spec.Audiences, []string{a}) {
+					valid = append(valid, a)
+				}
+			}
+			ok = ok && len(valid) > 0
+			audiences = valid
+		}
+		o.Status.Authenticated = ok
+		o.Status.Audiences = audiences
+		o.Status.User.Username = user
+	case *authzv1.SubjectAccessReview:
+		ra := o.Spec.ResourceAttributes
+		if ra.Verb != "get" || ra.Resource != "pods" {
+			return nil
+		}
+		for _, ns := range c.access[o.Spec.User] {
+			if ns == ra.Namespace {
+				o.Status.Allowed = true
+			}
+		}
+	default:
+		return c.Client.Create(ctx, obj, opts...)
+	}
+	return nil
+}
+
+func newTestKubeClient(obj ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(obj...).
+		Build()
+}
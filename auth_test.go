@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	auth, err := newTokenAuthenticator(map[string]tenantConfig{
+		"buzz": {
+			Token: "buzz-token",
+			EnforcedLabels: map[string]string{
+				"foo": "buzz",
+			},
+		},
+		"other": {
+			Token:     "other-token",
+			Endpoints: []string{"other"},
+		},
+	})
+	require.NoError(t, err)
+
+	h := authenticate("test", auth, multiHandler("/test", testMultiMetricsFetcher, nil))
+
+	tcs := map[string]struct {
+		authorization string
+
+		code int
+		body string
+	}{
+		"NoToken": {
+			code: http.StatusUnauthorized,
+		},
+		"WrongScheme": {
+			authorization: "Basic buzz-token",
+			code:          http.StatusUnauthorized,
+		},
+		"UnknownToken": {
+			authorization: "Bearer foo-token",
+			code:          http.StatusUnauthorized,
+		},
+		"NoAccess": {
+			authorization: "Bearer other-token",
+			code:          http.StatusForbidden,
+		},
+		"Filtered": {
+			authorization: "Bearer buzz-token",
+			code:          http.StatusOK,
+			body:          expectedMulitHandlerFoo,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/test/foo?foo=~.*", nil)
+			require.NoError(t, err)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, tc.code, rr.Code)
+			if tc.code == http.StatusUnauthorized {
+				assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+			}
+			if tc.body != "" {
+				assert.Equal(t, tc.body, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenAuthenticator_InvalidConfig(t *testing.T) {
+	_, err := newTokenAuthenticator(map[string]tenantConfig{
+		"a": {},
+	})
+	assert.Error(t, err)
+
+	_, err = newTokenAuthenticator(map[string]tenantConfig{
+		"a": {Token: "foo"},
+		"b": {Token: "foo"},
+	})
+	assert.Error(t, err)
+
+	_, err = newTokenAuthenticator(map[string]tenantConfig{
+		"a": {
+			Token: "foo",
+			EnforcedLabels: map[string]string{
+				"foo": `~"(bar"`,
+			},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestAuthenticate_NoAuth(t *testing.T) {
+	h := authenticate("test", nil, multiHandler("/test", testMultiMetricsFetcher, nil))
+
+	req, err := http.NewRequest("GET", "/test/foo?foo=buzz", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedMulitHandlerFoo, rr.Body.String())
+}
+
+func TestMultiAuthenticator(t *testing.T) {
+	ta, err := newTokenAuthenticator(map[string]tenantConfig{
+		"static": {
+			Token: "static-token",
+		},
+	})
+	require.NoError(t, err)
+	ka := newKubeAuthenticator(&fakeReviewClient{
+		Client: newTestKubeClient(),
+		users: map[string]string{
+			"kube-token": "system:serviceaccount:a:prometheus",
+		},
+		access: map[string][]string{
+			"system:serviceaccount:a:prometheus": {"a"},
+		},
+	}, kubeAuthConfig{})
+	auth := multiAuthenticator{ta, ka}
+
+	req, err := http.NewRequest("GET", "/test/ns?namespace=a", nil)
+	require.NoError(t, err)
+
+	_, err = auth.Authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated)
+
+	req.Header.Set("Authorization", "Bearer static-token")
+	tenant, err := auth.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "static", tenant.name)
+
+	req.Header.Set("Authorization", "Bearer kube-token")
+	tenant, err = auth.Authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, "system:serviceaccount:a:prometheus", tenant.name)
+
+	req.Header.Set("Authorization", "Bearer other-token")
+	_, err = auth.Authenticate(req)
+	assert.ErrorIs(t, err, errUnauthenticated)
+}
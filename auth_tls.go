@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	certSourceCN  = "CN"
+	certSourceSAN = "SAN"
+)
+
+// certAuthenticator authenticates requests using verified TLS client certificates.
+// The common name or the DNS subject alternative names of the certificate are mapped onto a label matcher that is
+// enforced for the caller.
+type certAuthenticator struct {
+	source string
+	label  string
+}
+
+func newCertAuthenticator(source, label string) (*certAuthenticator, error) {
+	if source != certSourceCN && source != certSourceSAN {
+		return nil, fmt.Errorf("invalid tenant_from %q, must be %q or %q", source, certSourceCN, certSourceSAN)
+	}
+	if label == "" {
+		return nil, errors.New("tenant_label needs to be set")
+	}
+	return &certAuthenticator{
+		source: source,
+		label:  label,
+	}, nil
+}
+
+func (a *certAuthenticator) Authenticate(r *http.Request) (*tenant, error) {
+	// Only trust certificates that were verified against the client CA
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errUnauthenticated
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	values := []string{}
+	switch a.source {
+	case certSourceCN:
+		if cert.Subject.CommonName != "" {
+			values = append(values, cert.Subject.CommonName)
+		}
+	case certSourceSAN:
+		values = append(values, cert.DNSNames...)
+	}
+	if len(values) == 0 {
+		return nil, errForbidden
+	}
+
+	m, err := newSetMatcher(a.label, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenant{
+		name:     cert.Subject.CommonName,
+		matchers: matcherSet{m},
+	}, nil
+}
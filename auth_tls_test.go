@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertAuthenticator(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "team-a"},
+		DNSNames: []string{"a", "shared"},
+	}
+
+	tcs := map[string]struct {
+		source string
+		state  *tls.ConnectionState
+
+		err      error
+		expected string
+	}{
+		"NoTLS": {
+			source: certSourceCN,
+			err:    errUnauthenticated,
+		},
+		"NotVerified": {
+			source: certSourceCN,
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+			err: errUnauthenticated,
+		},
+		"CN": {
+			source: certSourceCN,
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			},
+			expected: `{namespace="team-a"}`,
+		},
+		"SAN": {
+			source: certSourceSAN,
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			},
+			expected: `{namespace=~"a|shared"}`,
+		},
+		"NoSAN": {
+			source: certSourceSAN,
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "team-a"}}},
+				VerifiedChains:   [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "team-a"}}}},
+			},
+			err: errForbidden,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			auth, err := newCertAuthenticator(tc.source, "namespace")
+			require.NoError(t, err)
+
+			req, err := http.NewRequest("GET", "/", nil)
+			require.NoError(t, err)
+			req.TLS = tc.state
+
+			tenant, err := auth.Authenticate(req)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "team-a", tenant.name)
+			assert.Equal(t, tc.expected, tenant.matchers.String())
+		})
+	}
+}
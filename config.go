@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -10,6 +16,12 @@ import (
 type config struct {
 	Addr      string                    `yaml:"addr"`
 	Endpoints map[string]endpointConfig `yaml:"endpoints"`
+	Tenants   map[string]tenantConfig   `yaml:"tenants"`
+
+	KubernetesAuth *kubeAuthConfig `yaml:"kubernetes_auth"`
+	JWTAuth        *jwtAuthConfig  `yaml:"jwt_auth"`
+
+	TLSServerConfig *tlsServerConfig `yaml:"tls_server_config"`
 }
 
 type endpointConfig struct {
@@ -17,24 +29,67 @@ type endpointConfig struct {
 	Target             string        `yaml:"target"`
 	KubernetesTarget   *kubeTarget   `yaml:"kubernetes_target"`
 	RefreshInterval    time.Duration `yaml:"refresh_interval"`
+	BackgroundRefresh  bool          `yaml:"background_refresh"`
+	MaxStaleness       time.Duration `yaml:"max_staleness"`
 	Auth               endpointAuth  `yaml:"auth"`
 	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	// TLSConfig configures the TLS connections to the exporter.
+	TLSConfig *tlsClientConfig `yaml:"tls_config"`
+
+	// EnforcedLabels are label matchers that are always applied to the metrics of this endpoint.
+	// They use the same syntax as the URL parameters. URL parameters can only narrow them down further.
+	EnforcedLabels map[string]string `yaml:"enforced_labels"`
 }
 
 type kubeTarget struct {
 	Endpoint kubeEndpointTarget `yaml:"endpoint"`
+	// Pods selects pods by label instead of through a service. If set, Endpoint is ignored.
+	Pods *kubePodsTarget `yaml:"pods"`
+	// Aggregate serves the metrics of all discovered pods at the path of the endpoint instead of the service discovery.
+	Aggregate bool `yaml:"aggregate"`
+	// AggregatePodLabel is the label the name of the pod is added as when aggregating. No label is added if empty.
+	AggregatePodLabel string `yaml:"aggregate_pod_label"`
 }
 type kubeEndpointTarget struct {
 	Name      string `yaml:"name"`
 	Namespace string `yaml:"namespace"`
-	Port      int    `yaml:"port"`
+	Port      string `yaml:"port"`
 	Path      string `yaml:"path"`
 	Scheme    string `yaml:"scheme"`
+	// Discovery is either `endpoints` or `endpointslices`. Defaults to `endpoints`.
+	Discovery string `yaml:"discovery"`
+	// PodMetadata adds the labels and annotations of the pods backing the endpoints to the service discovery response.
+	// This requires permission to watch pods.
+	PodMetadata bool `yaml:"pod_metadata"`
+
+	// Selector selects services through a label selector instead of by name.
+	// The services are discovered in Namespace, Namespaces, or the namespaces matching NamespaceSelector.
+	Selector          string   `yaml:"selector"`
+	Namespaces        []string `yaml:"namespaces"`
+	NamespaceSelector string   `yaml:"namespace_selector"`
+}
+
+type kubePodsTarget struct {
+	// Namespaces are the namespaces to discover pods in. If empty, pods are discovered in all namespaces.
+	Namespaces []string `yaml:"namespaces"`
+	// Selector is a label selector, for example `app=node-exporter`.
+	Selector string `yaml:"selector"`
+	// Port is the name or number of the container port that exposes the metrics.
+	Port   string `yaml:"port"`
+	Path   string `yaml:"path"`
+	Scheme string `yaml:"scheme"`
 }
 
 type endpointAuth struct {
-	Type  authType `yaml:"type"`
-	Token string   `yaml:"token"`
+	Type authType `yaml:"type"`
+	// Token or TokenFile set the token of the Bearer auth type.
+	// The file is read again whenever it changes, so it can be mounted from a Secret.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// Username and Password or PasswordFile set the credentials of the Basic auth type.
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
 }
 
 type authType string
@@ -42,25 +97,216 @@ type authType string
 var (
 	authModeNone   authType = ""
 	authModeBearer authType = "Bearer"
+	authModeBasic  authType = "Basic"
 	authModeKube   authType = "Kubernetes"
 )
 
-func readConfig(path string) (config, error) {
+type tenantConfig struct {
+	Token string `yaml:"token"`
+	// EnforcedLabels are label matchers that are always applied to the metrics served to the tenant.
+	EnforcedLabels map[string]string `yaml:"enforced_labels"`
+	// Endpoints are the names of the endpoints the tenant has access to. If empty, the tenant has access to all endpoints.
+	Endpoints []string `yaml:"endpoints"`
+}
+
+// kubeAuthConfig configures authentication of requests through Kubernetes TokenReviews and SubjectAccessReviews.
+type kubeAuthConfig struct {
+	// NamespaceLabel is the label that contains the namespace of a metric. Defaults to `namespace`.
+	NamespaceLabel string `yaml:"namespace_label"`
+	// Verb, Group, and Resource describe the access a caller needs in a namespace to see its metrics.
+	// Defaults to `get` `pods`.
+	Verb     string `yaml:"verb"`
+	Group    string `yaml:"group"`
+	Resource string `yaml:"resource"`
+	// CacheTTL is how long the result of a review is cached. If not set, the results are not cached.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// Audiences are the audiences the tokens need to be issued for. If not set, the audiences of the API server are
+	// accepted, which includes tokens of any workload that talks to the API server.
+	Audiences []string `yaml:"audiences"`
+}
+
+// jwtAuthConfig configures authentication of requests through JWTs.
+type jwtAuthConfig struct {
+	// JWKSFile or JWKSURL point to the JSON Web Key Set that is used to verify the tokens.
+	JWKSFile string `yaml:"jwks_file"`
+	JWKSURL  string `yaml:"jwks_url"`
+	// JWKSRefreshInterval is how often the key set is reloaded. Defaults to one hour.
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+
+	// Issuer and Audience are validated if set.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+
+	// Claim is the name of the claim whose values are mapped onto the label Label.
+	Claim string `yaml:"claim"`
+	Label string `yaml:"label"`
+}
+
+// tlsServerConfig configures the server to serve TLS and optionally authenticate callers using client certificates.
+type tlsServerConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuthType is one of the Go tls.ClientAuthType names, for example `RequireAndVerifyClientCert`.
+	// Defaults to `RequireAndVerifyClientCert` if ClientCAFile is set and to `NoClientCert` otherwise.
+	ClientAuthType string `yaml:"client_auth_type"`
+
+	// TenantFrom is either `CN` or `SAN`. If set, callers are authenticated by their client certificate
+	// and the common name or DNS subject alternative names are mapped onto the label TenantLabel.
+	TenantFrom  string `yaml:"tenant_from"`
+	TenantLabel string `yaml:"tenant_label"`
+}
+
+// tlsClientConfig configures the TLS connections to an exporter, similar to the tls_config of Prometheus.
+// The files are loaded again whenever one of them changes.
+type tlsClientConfig struct {
+	// CAFile is the CA bundle used to verify the certificate of the exporter. Defaults to the system CAs.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented to the exporter.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName is used to verify the certificate of the exporter instead of the host name of the target.
+	ServerName string `yaml:"server_name"`
+	// MinVersion is one of `TLS10`, `TLS11`, `TLS12`, and `TLS13`. Defaults to `TLS12`.
+	MinVersion string `yaml:"min_version"`
+}
+
+func (c endpointConfig) enforcedMatchers() (matcherSet, error) {
+	return parseEnforcedLabels(c.EnforcedLabels)
+}
+
+func (c tenantConfig) tenant(name string) (*tenant, error) {
+	ms, err := parseEnforcedLabels(c.EnforcedLabels)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: %w", name, err)
+	}
+	t := &tenant{
+		name:     name,
+		matchers: ms,
+	}
+	if len(c.Endpoints) > 0 {
+		t.endpoints = map[string]bool{}
+		for _, e := range c.Endpoints {
+			t.endpoints[e] = true
+		}
+	}
+	return t, nil
+}
+
+func parseEnforcedLabels(labels map[string]string) (matcherSet, error) {
+	ms := matcherSet{}
+	for k, v := range labels {
+		m, err := parseMatcherParam(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enforced label: %w", err)
+		}
+		ms = append(ms, m)
+	}
+	sortMatchers(ms)
+	return ms, nil
+}
+
+// readConfig reads and validates the configuration file at path and returns its content together with the parsed configuration.
+// If path is empty, the default configuration is returned.
+func readConfig(path string) ([]byte, config, error) {
 	conf := config{
 		Addr: ":80",
 	}
 
 	if path == "" {
-		return conf, nil
+		return nil, conf, nil
 	}
 	configFile, err := os.ReadFile(path)
 	if err != nil {
-		return config{}, err
+		return nil, config{}, err
 	}
 
-	err = yaml.Unmarshal(configFile, &conf)
+	expanded, err := expandEnv(configFile)
 	if err != nil {
-		return config{}, err
+		return nil, config{}, err
+	}
+
+	// Reject unknown fields, so that typos don't silently fall back to the defaults.
+	// The decoder continues after unknown fields and wrong types, so they are reported together with the other problems.
+	errs := configErrors{}
+	dec := yaml.NewDecoder(bytes.NewReader(expanded))
+	dec.KnownFields(true)
+	err = dec.Decode(&conf)
+	var typeErr *yaml.TypeError
+	switch {
+	case errors.As(err, &typeErr):
+		errs = append(errs, typeErr.Errors...)
+	case err != nil && !errors.Is(err, io.EOF):
+		return nil, config{}, err
+	}
+	if err := conf.validate(); err != nil {
+		var invalid configErrors
+		if !errors.As(err, &invalid) {
+			return nil, config{}, err
+		}
+		errs = append(errs, invalid...)
+	}
+	if len(errs) > 0 {
+		return nil, config{}, errs
+	}
+	return configFile, conf, nil
+}
+
+// envVarRE matches `${VAR}` and the escaped form `$${VAR}`.
+var envVarRE = regexp.MustCompile(`\$?\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// expandEnv replaces every `${VAR}` in the values of the configuration with the value of the environment variable VAR
+// and returns the configuration encoded again, or nil if it's empty.
+// `$${VAR}` is replaced with a literal `${VAR}`. It's an error to reference a variable that is not set.
+// Keys and comments are not expanded, and the values are quoted as needed when encoding, so that the value of a
+// variable can't change the structure of the configuration.
+func expandEnv(conf []byte) ([]byte, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(conf, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		return nil, nil
+	}
+
+	missing := []string{}
+	expandNode(&doc, &missing)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables %s are not set", strings.Join(missing, ", "))
+	}
+	return yaml.Marshal(&doc)
+}
+
+// expandNode expands the variables in all scalar values below the node and adds the names of unset variables to missing.
+// Aliases are skipped, as their anchors are expanded already.
+func expandNode(n *yaml.Node, missing *[]string) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		expanded := envVarRE.ReplaceAllStringFunc(n.Value, func(match string) string {
+			if match[1] == '$' {
+				return match[1:]
+			}
+			name := match[2 : len(match)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*missing = append(*missing, name)
+			}
+			return value
+		})
+		if expanded != n.Value {
+			n.Value = expanded
+			// Unquoted values are resolved again, so that variables can be used for numbers and booleans
+			if n.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle|yaml.TaggedStyle) == 0 {
+				n.Tag = ""
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			expandNode(n.Content[i], missing)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			expandNode(c, missing)
+		}
 	}
-	return conf, nil
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, path, `
+addr: :8082
+endpoints:
+  node:
+    path: /node
+    target: http://node.example.com:9100/metrics
+    refresh_interval: 7s
+  dns:
+    path: /dns
+    kubernetes_target:
+      endpoint:
+        name: kube-dns
+        namespace: kube-system
+        port: metrics
+        scheme: http
+`)
+	_, conf, err := readConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":8082", conf.Addr)
+	assert.Equal(t, 7*time.Second, conf.Endpoints["node"].RefreshInterval)
+	assert.Equal(t, "metrics", conf.Endpoints["dns"].KubernetesTarget.Endpoint.Port)
+
+	writeTestConfig(t, path, "")
+	_, conf, err = readConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":80", conf.Addr)
+}
+
+func TestReadConfig_UnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, path, `
+endpoints:
+  node:
+    path: /node
+    target: http://node.example.com:9100/metrics
+    refresh-interval: 7s
+  node-copy:
+    path: /node
+    target: http://node.example.com:9100/metrics
+  dns:
+    path: /dns
+    kubernetes_targets: {}
+`)
+	_, _, err := readConfig(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "refresh-interval")
+	assert.Contains(t, err.Error(), "kubernetes_targets")
+
+	// The other problems are reported together with the unknown fields
+	var errs configErrors
+	require.True(t, errors.As(err, &errs), "expected configErrors, got %v", err)
+	assert.True(t, containsPrefix(errs, "endpoints.dns: either target or kubernetes_target needs to be set"), err.Error())
+	assert.True(t, containsPrefix(errs, `endpoints.node-copy: path "/node" conflicts with endpoint "node"`), err.Error())
+}
+
+func TestReadConfig_Env(t *testing.T) {
+	t.Setenv("TEST_EXPORTER_TOKEN", "s3cr3t")
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, path, `
+endpoints:
+  node:
+    path: /node
+    target: http://node.example.com:9100/metrics?name=$${NAME}
+    auth:
+      type: Bearer
+      token: ${TEST_EXPORTER_TOKEN}
+`)
+	raw, conf, err := readConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", conf.Endpoints["node"].Auth.Token)
+	assert.Equal(t, "http://node.example.com:9100/metrics?name=${NAME}", conf.Endpoints["node"].Target)
+	assert.Contains(t, string(raw), "${TEST_EXPORTER_TOKEN}", "the content of the file is returned unexpanded")
+
+	// Comments are not expanded and the values are quoted as needed
+	t.Setenv("TEST_EXPORTER_PASSWORD", "pass # word\n  target: http://evil.example.com")
+	t.Setenv("TEST_EXPORTER_INTERVAL", "30s")
+	writeTestConfig(t, path, `
+# The password is set through ${TEST_EXPORTER_UNSET}
+endpoints:
+  node:
+    path: /node
+    target: http://node.example.com:9100/metrics
+    refresh_interval: ${TEST_EXPORTER_INTERVAL}
+    auth:
+      type: Basic
+      username: "${TEST_EXPORTER_TOKEN}"
+      password: ${TEST_EXPORTER_PASSWORD} # from the secret
+`)
+	_, conf, err = readConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", conf.Endpoints["node"].Auth.Username)
+	assert.Equal(t, "pass # word\n  target: http://evil.example.com", conf.Endpoints["node"].Auth.Password)
+	assert.Equal(t, "http://node.example.com:9100/metrics", conf.Endpoints["node"].Target)
+	assert.Equal(t, 30*time.Second, conf.Endpoints["node"].RefreshInterval)
+
+	writeTestConfig(t, path, "addr: ${TEST_EXPORTER_MISSING_A}${TEST_EXPORTER_MISSING_B}\n")
+	_, _, err = readConfig(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TEST_EXPORTER_MISSING_A, TEST_EXPORTER_MISSING_B")
+}
+
+func TestConfigValidate(t *testing.T) {
+	validKube := &kubeTarget{
+		Endpoint: kubeEndpointTarget{Name: "exporter", Namespace: "default", Port: "metrics", Scheme: "http"},
+	}
+
+	tcs := map[string]struct {
+		conf     config
+		expected []string
+	}{
+		"valid": {
+			conf: config{
+				Addr: ":80",
+				Endpoints: map[string]endpointConfig{
+					"static": {Path: "/static", Target: "http://example.com/metrics"},
+					"kube":   {Path: "/kube", KubernetesTarget: validKube},
+				},
+				Tenants: map[string]tenantConfig{
+					"a": {Token: "a", Endpoints: []string{"static"}},
+				},
+			},
+		},
+		"duplicatePath": {
+			conf: config{
+				Addr: ":80",
+				Endpoints: map[string]endpointConfig{
+					"a": {Path: "/a", Target: "http://example.com/metrics"},
+					"b": {Path: "/a", Target: "http://example.com/metrics"},
+					"c": {Path: "/", Target: "http://example.com/metrics"},
+				},
+			},
+			expected: []string{
+				`endpoints.b: path "/a" conflicts with endpoint "a"`,
+				`endpoints.c: path "/" conflicts with the service discovery of all endpoints`,
+			},
+		},
+		"endpoint": {
+			conf: config{
+				Addr: ":80",
+				Endpoints: map[string]endpointConfig{
+					"none":    {Path: "/none"},
+					"both":    {Path: "/both", Target: "http://example.com", KubernetesTarget: validKube},
+					"scheme":  {Path: "/scheme", Target: "example.com:9100"},
+					"refresh": {Path: "refresh", Target: "http://example.com", BackgroundRefresh: true},
+					"auth":    {Path: "/auth", Target: "http://example.com", Auth: endpointAuth{Type: "Digest"}},
+					"bearer":  {Path: "/bearer", Target: "http://example.com", Auth: endpointAuth{Type: "Bearer", Token: "a", TokenFile: "token"}},
+					"basic":   {Path: "/basic", Target: "http://example.com", Auth: endpointAuth{Type: "Basic", PasswordFile: "password"}},
+					"tls":     {Path: "/tls", Target: "https://example.com", TLSConfig: &tlsClientConfig{CertFile: "tls.crt", MinVersion: "TLS1.3"}},
+					"labels":  {Path: "/labels", Target: "http://example.com", EnforcedLabels: map[string]string{"namespace": `~"("`}},
+				},
+			},
+			expected: []string{
+				"endpoints.auth: auth.type",
+				"endpoints.both: only one of target and kubernetes_target can be set",
+				"endpoints.labels: invalid enforced label",
+				"endpoints.none: either target or kubernetes_target needs to be set",
+				"endpoints.refresh: path needs to start with `/`",
+				"endpoints.refresh: background_refresh requires refresh_interval to be set",
+				`endpoints.scheme: target "example.com:9100" needs to be an http or https URL`,
+			},
+		},
+		"kubernetes": {
+			conf: config{
+				Addr: ":80",
+				Endpoints: map[string]endpointConfig{
+					"endpoint": {Path: "/endpoint", KubernetesTarget: &kubeTarget{
+						Endpoint: kubeEndpointTarget{Name: "exporter", Selector: "app=exporter", Discovery: "dns"},
+					}},
+					"pods": {Path: "/pods", KubernetesTarget: &kubeTarget{
+						Pods: &kubePodsTarget{Selector: "app in (", Port: "metrics", Scheme: "http"},
+					}},
+					"namespace": {Path: "/namespace", KubernetesTarget: &kubeTarget{
+						Endpoint: kubeEndpointTarget{Name: "exporter", Port: "metrics", Scheme: "http"},
+					}},
+					"aggregate": {Path: "/aggregate", KubernetesTarget: &kubeTarget{
+						Endpoint:          validKube.Endpoint,
+						AggregatePodLabel: "instance",
+					}},
+				},
+			},
+			expected: []string{
+				"endpoints.aggregate: kubernetes_target.aggregate_pod_label requires kubernetes_target.aggregate to be set",
+				`endpoints.aggregate: kubernetes_target.aggregate_pod_label "instance" is not a valid label name`,
+				"endpoints.endpoint: kubernetes_target.endpoint.name and selector can't be set at the same time",
+				`endpoints.endpoint: kubernetes_target.endpoint.discovery "dns" is unknown`,
+				"endpoints.endpoint: kubernetes_target.endpoint.port needs to be set",
+				`endpoints.endpoint: kubernetes_target.endpoint.scheme "" is invalid`,
+				"endpoints.namespace: kubernetes_target.endpoint.namespace needs to be set if name is set",
+				"endpoints.pods: kubernetes_target.pods.selector is invalid",
+			},
+		},
+		"tenants": {
+			conf: config{
+				Addr: ":80",
+				Tenants: map[string]tenantConfig{
+					"a": {Token: "a", Endpoints: []string{"missing"}},
+					"b": {Token: "a"},
+					"c": {},
+				},
+			},
+			expected: []string{
+				`tenants.a: unknown endpoint "missing"`,
+				"tenants.b: token is used by another tenant",
+				"tenants.c: token needs to be set",
+			},
+		},
+		"auth": {
+			conf: config{
+				Addr:            ":80",
+				JWTAuth:         &jwtAuthConfig{JWKSFile: "jwks.json", JWKSURL: "https://example.com"},
+				TLSServerConfig: &tlsServerConfig{ClientAuthType: "RequireAndVerifyClientCert", TenantFrom: "UID"},
+			},
+			expected: []string{
+				"jwt_auth: exactly one of jwks_file or jwks_url needs to be set",
+				"jwt_auth: claim and label need to be set",
+				"jwt_auth: issuer and audience need to be set",
+				"tls_server_config: cert_file and key_file need to be set",
+				`tls_server_config: client_auth_type "RequireAndVerifyClientCert" requires client_ca_file to be set`,
+				`tls_server_config: tenant_from "UID" is unknown`,
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			err := tc.conf.validate()
+			if len(tc.expected) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var errs configErrors
+			require.True(t, errors.As(err, &errs), "expected configErrors, got %v", err)
+			for _, e := range tc.expected {
+				assert.True(t, containsPrefix(errs, e), "expected error %q in:\n%s", e, err.Error())
+			}
+		})
+	}
+}
+
+func containsPrefix(errs configErrors, prefix string) bool {
+	for _, e := range errs {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+	return false
+}
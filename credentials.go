@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vshn/exporter-filterproxy/target"
+)
+
+// kubeTokenMaxAge is how long the service account token is used before it is read again, even if the file didn't change.
+const kubeTokenMaxAge = time.Minute
+
+// newAuthorizer returns the Authorizer for the requests to the exporter of an endpoint, or nil if no authorization is configured.
+func newAuthorizer(conf endpointAuth) (target.Authorizer, error) {
+	switch conf.Type {
+	case authModeBearer:
+		if conf.TokenFile != "" {
+			return newFileAuthorizer(conf.TokenFile, bearer)
+		}
+		return target.StaticAuthorization(bearer(conf.Token)), nil
+	case authModeBasic:
+		basic := func(password string) string {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(conf.Username+":"+password))
+		}
+		if conf.PasswordFile != "" {
+			return newFileAuthorizer(conf.PasswordFile, basic)
+		}
+		return target.StaticAuthorization(basic(conf.Password)), nil
+	case authModeKube:
+		a, err := newFileAuthorizer(kubeSAPath, bearer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get kubernetes serviceaccount token: %w", err)
+		}
+		// Bound service account tokens are rotated by the kubelet and expire after an hour
+		a.maxAge = kubeTokenMaxAge
+		return a, nil
+	case authModeNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unkown auth type: %q", conf.Type)
+	}
+}
+
+func bearer(token string) string {
+	return "Bearer " + token
+}
+
+// fileAuthorizer reads a secret from a file and reads it again whenever the file changes.
+// Mounted Secrets are updated by replacing a symlink, which changes the modification time of the file.
+type fileAuthorizer struct {
+	path string
+	// format turns the secret into the value of the Authorization header
+	format func(secret string) string
+	// maxAge is how long the secret is used before the file is read again, even if its modification time didn't change.
+	// If it's zero, the file is only read again if it changes or the secret is invalidated.
+	maxAge time.Duration
+
+	mutex         sync.Mutex
+	modTime       time.Time
+	readAt        time.Time
+	invalidated   bool
+	authorization string
+}
+
+// newFileAuthorizer returns a fileAuthorizer for the file at path. The file is read once, to fail early if it can't be read.
+func newFileAuthorizer(path string, format func(secret string) string) (*fileAuthorizer, error) {
+	a := &fileAuthorizer{
+		path:   path,
+		format: format,
+	}
+	if _, err := a.Authorization(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Authorization returns the value of the Authorization header using the current content of the file.
+// If the file can't be read anymore, the last content is used.
+func (a *fileAuthorizer) Authorization() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	fi, err := os.Stat(a.path)
+	if err == nil && fi.ModTime().Equal(a.modTime) && !a.invalidated && (a.maxAge == 0 || time.Since(a.readAt) < a.maxAge) {
+		return a.authorization, nil
+	}
+	var secret []byte
+	if err == nil {
+		secret, err = os.ReadFile(a.path)
+	}
+	if err != nil {
+		if a.modTime.IsZero() {
+			return "", fmt.Errorf("failed to read credentials: %w", err)
+		}
+		log.Printf("Failed to read credentials, using the previous ones: %s", err.Error())
+		return a.authorization, nil
+	}
+
+	a.modTime = fi.ModTime()
+	a.readAt = time.Now()
+	a.invalidated = false
+	a.authorization = a.format(strings.TrimSpace(string(secret)))
+	return a.authorization, nil
+}
+
+// Invalidate makes sure the file is read again the next time the secret is used.
+// It's called if the target rejects the secret, which might have been rotated without changing the modification time.
+func (a *fileAuthorizer) Invalidate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.invalidated = true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAuthorizer(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("pass\n"), 0o600))
+
+	tcs := map[string]struct {
+		conf     endpointAuth
+		expected string
+	}{
+		"bearer": {
+			conf:     endpointAuth{Type: authModeBearer, Token: "foo"},
+			expected: "Bearer foo",
+		},
+		"basic": {
+			conf:     endpointAuth{Type: authModeBasic, Username: "user", Password: "pass"},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+		"basicFile": {
+			conf:     endpointAuth{Type: authModeBasic, Username: "user", PasswordFile: passwordFile},
+			expected: "Basic dXNlcjpwYXNz",
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			a, err := newAuthorizer(tc.conf)
+			require.NoError(t, err)
+			auth, err := a.Authorization()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, auth)
+		})
+	}
+
+	a, err := newAuthorizer(endpointAuth{Type: authModeNone})
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	_, err = newAuthorizer(endpointAuth{Type: authModeBearer, TokenFile: filepath.Join(dir, "missing")})
+	assert.Error(t, err, "missing credential files are reported at startup")
+}
+
+func TestFileAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+
+	a, err := newAuthorizer(endpointAuth{Type: authModeBearer, TokenFile: path})
+	require.NoError(t, err)
+	auth, err := a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer first", auth)
+
+	require.NoError(t, os.WriteFile(path, []byte("second"), 0o600))
+	// Make sure the modification time changes, independent of the resolution of the file system
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	auth, err = a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer second", auth)
+
+	// Invalidated credentials are read again, even if the file didn't change
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("third"), 0o600))
+	require.NoError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+	auth, err = a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer second", auth)
+	a.(*fileAuthorizer).Invalidate()
+	auth, err = a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer third", auth)
+
+	// The last credentials are used while the file is missing
+	require.NoError(t, os.Remove(path))
+	auth, err = a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer third", auth)
+}
+
+func TestKubeAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(path, []byte("first\n"), 0o600))
+	defer func(p string) { kubeSAPath = p }(kubeSAPath)
+	kubeSAPath = path
+
+	a, err := newAuthorizer(endpointAuth{Type: authModeKube})
+	require.NoError(t, err)
+	auth, err := a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer first", auth)
+
+	// The token is read again once it is older than kubeTokenMaxAge, even if the modification time didn't change
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("second\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()))
+	a.(*fileAuthorizer).readAt = time.Now().Add(-kubeTokenMaxAge)
+	auth, err = a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer second", auth)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 
+	"github.com/prometheus/common/model"
 	"github.com/vshn/exporter-filterproxy/target"
 )
 
@@ -27,3 +28,32 @@ func (mf multiTargetConfigFetcher) FetchTargetConfigs(ctx context.Context, baseT
 
 	return configs, nil
 }
+
+// endpointTargetConfigFetcher only returns the targets of the endpoint if the tenant of the request has access to it,
+// so that the service discovery of all endpoints doesn't reveal the targets of other endpoints.
+type endpointTargetConfigFetcher struct {
+	endpoint string
+	targetConfigFetcher
+}
+
+func (f endpointTargetConfigFetcher) FetchTargetConfigs(ctx context.Context, baseTarget string, basePath string) ([]target.StaticConfig, error) {
+	if t := tenantFrom(ctx); t != nil && !t.canAccess(f.endpoint) {
+		return nil, nil
+	}
+	return f.targetConfigFetcher.FetchTargetConfigs(ctx, baseTarget, basePath)
+}
+
+// aggregatedTargetConfigFetcher exposes an endpoint that serves the metrics of all its targets at its path as a single target.
+type aggregatedTargetConfigFetcher struct{}
+
+func (aggregatedTargetConfigFetcher) FetchTargetConfigs(ctx context.Context, baseTarget string, basePath string) ([]target.StaticConfig, error) {
+	return []target.StaticConfig{
+		{
+			Targets: []string{baseTarget},
+			Labels: model.LabelSet{
+				"__metrics_path__": model.LabelValue(basePath),
+				"metrics_path":     model.LabelValue(basePath),
+			},
+		},
+	}, nil
+}
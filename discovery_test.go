@@ -72,6 +72,41 @@ func TestMultiTargetConfigFetcher(t *testing.T) {
 
 }
 
+func TestMultiTargetConfigFetcher_Tenant(t *testing.T) {
+	fetcher := func(path string, foo string) endpointTargetConfigFetcher {
+		return endpointTargetConfigFetcher{
+			endpoint: path[1:],
+			targetConfigFetcher: fakeTargetConfigFetcher{
+				t:      t,
+				path:   path,
+				target: "proxy.example.com",
+				configs: []target.StaticConfig{
+					{
+						Targets: []string{"proxy.example.com"},
+						Labels:  model.LabelSet{"foo": model.LabelValue(foo)},
+					},
+				},
+			},
+		}
+	}
+	mf := multiTargetConfigFetcher{
+		"/a": fetcher("/a", "a"),
+		"/b": fetcher("/b", "b"),
+		"/c": fetcher("/c", "c"),
+	}
+
+	ctx := withTenant(context.TODO(), &tenant{name: "team-a", endpoints: map[string]bool{"a": true}})
+	conf, err := mf.FetchTargetConfigs(ctx, "proxy.example.com", "")
+	require.NoError(t, err)
+	require.Len(t, conf, 1, "the tenant must only see the endpoints it has access to")
+	assert.Equal(t, model.LabelValue("a"), conf[0].Labels["foo"])
+
+	ctx = withTenant(context.TODO(), &tenant{name: "admin"})
+	conf, err = mf.FetchTargetConfigs(ctx, "proxy.example.com", "")
+	require.NoError(t, err)
+	assert.Len(t, conf, 3)
+}
+
 type fakeTargetConfigFetcher struct {
 	configs []target.StaticConfig
 	t       *testing.T
@@ -5,11 +5,11 @@ import (
 )
 
 // Filter takes a slice of MetricFamily and returns a slice of MetricFamily that only contains the
-// metrics that have *all* labels in the filterLabels.
-func Filter(metrics []dto.MetricFamily, filterLabels map[string]string) []dto.MetricFamily {
+// metrics that are selected by the filter.
+func Filter(metrics []dto.MetricFamily, filter seriesFilter) []dto.MetricFamily {
 	res := []dto.MetricFamily{}
 	for _, mf := range metrics {
-		fmf := filterMetricFamily(mf, filterLabels)
+		fmf := filterMetricFamily(mf, filter)
 		if len(fmf.Metric) == 0 {
 			continue
 		}
@@ -18,10 +18,10 @@ func Filter(metrics []dto.MetricFamily, filterLabels map[string]string) []dto.Me
 	return res
 }
 
-func filterMetricFamily(mf dto.MetricFamily, filterLabels map[string]string) *dto.MetricFamily {
+func filterMetricFamily(mf dto.MetricFamily, filter seriesFilter) *dto.MetricFamily {
 	ms := []*dto.Metric{}
 	for _, m := range mf.GetMetric() {
-		if matchesFilter(m, filterLabels) {
+		if matchesFilter(mf.GetName(), m, filter) {
 			ms = append(ms, m)
 		}
 	}
@@ -29,17 +29,6 @@ func filterMetricFamily(mf dto.MetricFamily, filterLabels map[string]string) *dt
 	return &mf
 }
 
-func matchesFilter(m *dto.Metric, filterLabels map[string]string) bool {
-	matched := 0
-
-	for _, l := range m.GetLabel() {
-		val, ok := filterLabels[l.GetName()]
-		if ok && l.GetValue() != val {
-			return false
-		} else if ok {
-			matched++
-		}
-	}
-
-	return matched == len(filterLabels)
+func matchesFilter(name string, m *dto.Metric, filter seriesFilter) bool {
+	return filter.matches(name, m)
 }
@@ -10,9 +10,9 @@ import (
 func TestFilter(t *testing.T) {
 
 	tcs := map[string]struct {
-		input        []dto.MetricFamily
-		filterLabels map[string]string
-		output       []dto.MetricFamily
+		input    []dto.MetricFamily
+		matchers matcherSet
+		output   []dto.MetricFamily
 	}{
 		"EmptyNoFilter": {
 			input:  []dto.MetricFamily{},
@@ -21,8 +21,8 @@ func TestFilter(t *testing.T) {
 		"Empty": {
 			input:  []dto.MetricFamily{},
 			output: []dto.MetricFamily{},
-			filterLabels: map[string]string{
-				"foo": "bar",
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", "bar"),
 			},
 		},
 
@@ -31,8 +31,8 @@ func TestFilter(t *testing.T) {
 				testMF("empty"),
 			},
 			output: []dto.MetricFamily{},
-			filterLabels: map[string]string{
-				"foo": "bar",
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", "bar"),
 			},
 		},
 		"OneFilter": {
@@ -49,8 +49,8 @@ func TestFilter(t *testing.T) {
 					testCounter(3, "foo", "bar", "other", "label"),
 				),
 			},
-			filterLabels: map[string]string{
-				"foo": "bar",
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", "bar"),
 			},
 		},
 		"TwoFilter": {
@@ -66,9 +66,9 @@ func TestFilter(t *testing.T) {
 					testCounter(3, "foo", "bar", "other", "label"),
 				),
 			},
-			filterLabels: map[string]string{
-				"foo":   "bar",
-				"other": "label",
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", "bar"),
+				testMatcher(matchEqual, "other", "label"),
 			},
 		},
 		"MultiMF": {
@@ -102,19 +102,275 @@ func TestFilter(t *testing.T) {
 					testCounter(1, "foo", "bar"),
 				),
 			},
-			filterLabels: map[string]string{
-				"foo": "bar",
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", "bar"),
+			},
+		},
+		"NotEqual": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "foo", "bar"),
+					testCounter(3, "foo", "bar", "other", "label"),
+					testCounter(2, "foo", "buzz"),
+					testCounter(4, "other", "label"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(2, "foo", "buzz"),
+					testCounter(4, "other", "label"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchNotEqual, "foo", "bar"),
+			},
+		},
+		"EqualEmpty": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "foo", "bar"),
+					testCounter(4, "other", "label"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(4, "other", "label"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchEqual, "foo", ""),
+			},
+		},
+		"Regexp": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "team-a-dev"),
+					testCounter(2, "namespace", "team-a-prod"),
+					testCounter(3, "namespace", "team-b-prod"),
+					testCounter(4, "namespace", "other-team-a-prod"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "team-a-dev"),
+					testCounter(2, "namespace", "team-a-prod"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchRegexp, "namespace", "team-a-.*"),
+			},
+		},
+		"RegexpAnchored": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "foo", "bar"),
+					testCounter(2, "foo", "barbar"),
+					testCounter(3, "foo", "foobar"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "foo", "bar"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchRegexp, "foo", "bar|buzz"),
+			},
+		},
+		"NotRegexp": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "team-a-dev"),
+					testCounter(2, "namespace", "team-a-prod"),
+					testCounter(3, "namespace", "team-b-prod"),
+				),
+				testMF("two",
+					testGauge(1, "namespace", "kube-system"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(3, "namespace", "team-b-prod"),
+				),
+				testMF("two",
+					testGauge(1, "namespace", "kube-system"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchNotRegexp, "namespace", "team-a-.*"),
+			},
+		},
+		"Set": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "a"),
+					testCounter(2, "namespace", "b"),
+					testCounter(3, "namespace", "c"),
+					testCounter(4, "other", "a"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "a"),
+					testCounter(2, "namespace", "b"),
+				),
+			},
+			matchers: matcherSet{
+				testAnyOf("namespace",
+					testMatcher(matchEqual, "namespace", "a"),
+					testMatcher(matchEqual, "namespace", "b"),
+				),
+			},
+		},
+		"SetAndRegexp": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "a.b"),
+					testCounter(2, "namespace", "axb"),
+					testCounter(3, "namespace", "team-c"),
+					testCounter(4, "namespace", "c"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "a.b"),
+					testCounter(3, "namespace", "team-c"),
+				),
+			},
+			matchers: matcherSet{
+				testAnyOf("namespace",
+					testMatcher(matchEqual, "namespace", "a.b"),
+					testMatcher(matchRegexp, "namespace", "team-.*"),
+				),
+			},
+		},
+		"Mixed": {
+			input: []dto.MetricFamily{
+				testMF("one",
+					testCounter(1, "namespace", "team-a-dev", "pod", "a"),
+					testCounter(2, "namespace", "team-a-prod", "pod", "b"),
+					testCounter(3, "namespace", "team-b-prod", "pod", "c"),
+				),
+			},
+			output: []dto.MetricFamily{
+				testMF("one",
+					testCounter(2, "namespace", "team-a-prod", "pod", "b"),
+				),
+			},
+			matchers: matcherSet{
+				testMatcher(matchRegexp, "namespace", "team-a-.*"),
+				testMatcher(matchNotEqual, "pod", "a"),
 			},
 		},
 	}
 
 	for name, tc := range tcs {
 		t.Run(name, func(t *testing.T) {
-			require.Equal(t, tc.output, Filter(tc.input, tc.filterLabels))
+			require.Equal(t, tc.output, Filter(tc.input, seriesFilter{tc.matchers}))
 		})
 	}
 }
 
+func TestFilterSelectors(t *testing.T) {
+
+	input := []dto.MetricFamily{
+		testMF("kube_pod_info",
+			testGauge(1, "namespace", "x", "pod", "a"),
+			testGauge(1, "namespace", "y", "pod", "b"),
+		),
+		testMF("kube_deployment_created",
+			testGauge(1, "namespace", "x", "deployment", "a"),
+			testGauge(1, "namespace", "y", "deployment", "b"),
+		),
+		testMF("kube_deployment_labels",
+			testGauge(1, "namespace", "y", "deployment", "b"),
+		),
+	}
+
+	tcs := map[string]struct {
+		filter seriesFilter
+		output []dto.MetricFamily
+	}{
+		"Empty": {
+			filter: seriesFilter{},
+			output: input,
+		},
+		"MetricName": {
+			filter: seriesFilter{
+				{
+					testMatcher(matchEqual, "__name__", "kube_pod_info"),
+				},
+			},
+			output: []dto.MetricFamily{
+				input[0],
+			},
+		},
+		"Or": {
+			filter: seriesFilter{
+				{
+					testMatcher(matchEqual, "__name__", "kube_pod_info"),
+					testMatcher(matchEqual, "namespace", "x"),
+				},
+				{
+					testMatcher(matchRegexp, "__name__", "kube_deployment_.*"),
+					testMatcher(matchEqual, "namespace", "y"),
+				},
+			},
+			output: []dto.MetricFamily{
+				testMF("kube_pod_info",
+					testGauge(1, "namespace", "x", "pod", "a"),
+				),
+				testMF("kube_deployment_created",
+					testGauge(1, "namespace", "y", "deployment", "b"),
+				),
+				testMF("kube_deployment_labels",
+					testGauge(1, "namespace", "y", "deployment", "b"),
+				),
+			},
+		},
+		"And": {
+			filter: seriesFilter{
+				{
+					testMatcher(matchEqual, "__name__", "kube_pod_info"),
+				},
+				{
+					testMatcher(matchEqual, "__name__", "kube_deployment_created"),
+				},
+			}.and(matcherSet{testMatcher(matchEqual, "namespace", "x")}),
+			output: []dto.MetricFamily{
+				testMF("kube_pod_info",
+					testGauge(1, "namespace", "x", "pod", "a"),
+				),
+				testMF("kube_deployment_created",
+					testGauge(1, "namespace", "x", "deployment", "a"),
+				),
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.output, Filter(input, tc.filter))
+		})
+	}
+}
+
+func testMatcher(t matchType, name, value string) *labelMatcher {
+	m, err := newLabelMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func testAnyOf(name string, ms ...*labelMatcher) *labelMatcher {
+	m, err := anyOf(name, ms)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
 func testMF(name string, metrics ...*dto.Metric) dto.MetricFamily {
 	return dto.MetricFamily{
 		Name:   &name,
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/vshn/exporter-filterproxy/target"
 )
 
 type metricsFetcher interface {
@@ -22,39 +26,55 @@ type multiMetricsFetcher interface {
 	FetchMetricsFor(ctx context.Context, endpoint string) ([]dto.MetricFamily, error)
 }
 
-func handler(fetcher metricsFetcher) http.HandlerFunc {
+// handler returns a handler that serves the metrics of the fetcher.
+// The enforced matchers and the matchers of the authenticated tenant are always applied, independent of the requested filter.
+func handler(fetcher metricsFetcher, enforced matcherSet) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		filterLabels, err := parseURLParams(r.URL.Query())
+		filter, err := parseURLParams(r.URL.Query())
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		filter = filter.and(enforced).and(tenantMatchers(r.Context()))
 
 		metrics, err := fetcher.FetchMetrics(r.Context())
-		if err != nil {
+		var stale *target.StaleError
+		if errors.As(err, &stale) {
+			log.Printf("Serving stale metrics: %s", err.Error())
+		} else if err != nil {
 			log.Printf("Failed to fetch metrics: %s", err.Error())
 			w.WriteHeader(http.StatusBadGateway)
 			return
 		}
 
-		writeMetrics(w, metrics, filterLabels)
+		metrics = Filter(metrics, filter)
+		if stale != nil {
+			metrics = append(metrics, markStale(w, stale.LastUpdated))
+		}
+		writeMetrics(w, r, metrics)
 	})
 }
 
-func multiHandler(prefix string, fetcher multiMetricsFetcher) http.HandlerFunc {
+// multiHandler returns a handler that serves the metrics of the endpoint of the fetcher that is identified by the request path.
+// The enforced matchers and the matchers of the authenticated tenant are always applied, independent of the requested filter.
+func multiHandler(prefix string, fetcher multiMetricsFetcher, enforced matcherSet) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		filterLabels, err := parseURLParams(r.URL.Query())
+		filter, err := parseURLParams(r.URL.Query())
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		filter = filter.and(enforced).and(tenantMatchers(r.Context()))
 		endpoint := strings.TrimPrefix(r.URL.Path, prefix)
 		endpoint = strings.TrimPrefix(endpoint, "/")
 
 		metrics, err := fetcher.FetchMetricsFor(r.Context(), endpoint)
-		if err != nil {
+		var stale *target.StaleError
+		if errors.As(err, &stale) {
+			log.Printf("Serving stale metrics: %s", err.Error())
+		} else if err != nil {
 			log.Printf("Failed to fetch metrics: %s", err.Error())
 			w.WriteHeader(http.StatusBadGateway)
 			return
@@ -64,7 +84,11 @@ func multiHandler(prefix string, fetcher multiMetricsFetcher) http.HandlerFunc {
 			return
 		}
 
-		writeMetrics(w, metrics, filterLabels)
+		metrics = Filter(metrics, filter)
+		if stale != nil {
+			metrics = append(metrics, markStale(w, stale.LastUpdated))
+		}
+		writeMetrics(w, r, metrics)
 	})
 }
 
@@ -95,20 +119,97 @@ func serviceDiscoveryHandler(prefix string, fetcher targetConfigFetcher) http.Ha
 	})
 }
 
-func parseURLParams(values url.Values) (map[string]string, error) {
-	res := map[string]string{}
+// parseURLParams parses the URL parameters into a filter.
+// Every `match[]` parameter is parsed as a series selector and the selectors are combined with a logical OR,
+// all other parameters are parsed as label matchers that need to match in addition to the selectors.
+// If a label is matched multiple times, positive matchers are combined with a logical OR, so that `?namespace=a&namespace=b`
+// selects metrics where the namespace is either `a` or `b`, while negative matchers all need to match.
+// See parseMatcherParam for the supported syntax.
+func parseURLParams(values url.Values) (seriesFilter, error) {
+	selectors := seriesFilter{}
+	matchers := matcherSet{}
 	for k, v := range values {
-		if len(v) != 1 {
-			return nil, fmt.Errorf("invalid URL paramters")
+		if k == "match[]" {
+			for _, sel := range v {
+				ms, err := parseSelector(sel)
+				if err != nil {
+					return nil, err
+				}
+				selectors = append(selectors, ms)
+			}
+			continue
+		}
+
+		ms, err := parseMatcherParams(k, v)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, ms...)
+	}
+	sortMatchers(matchers)
+	return selectors.and(matchers), nil
+}
+
+func parseMatcherParams(key string, values []string) (matcherSet, error) {
+	positive := []*labelMatcher{}
+	res := matcherSet{}
+	for _, v := range values {
+		m, err := parseMatcherParam(key, v)
+		if err != nil {
+			return nil, err
+		}
+		if m.Type == matchEqual || m.Type == matchRegexp {
+			positive = append(positive, m)
+		} else {
+			res = append(res, m)
+		}
+	}
+
+	switch len(positive) {
+	case 0:
+	case 1:
+		res = append(res, positive[0])
+	default:
+		m, err := anyOf(positive[0].Name, positive)
+		if err != nil {
+			return nil, err
 		}
-		res[k] = v[0]
+		res = append(res, m)
 	}
 	return res, nil
 }
 
-func writeMetrics(w http.ResponseWriter, metrics []dto.MetricFamily, filterLabels map[string]string) {
-	enc := expfmt.NewEncoder(w, expfmt.FmtText)
-	for _, fm := range Filter(metrics, filterLabels) {
+// staleHeader is set on responses that contain stale metrics, to the time the metrics were fetched.
+const staleHeader = "X-Filterproxy-Stale"
+
+// markStale marks the response as containing metrics that were last fetched at lastUpdated and returns a
+// synthetic metric that exposes how old they are.
+func markStale(w http.ResponseWriter, lastUpdated time.Time) dto.MetricFamily {
+	w.Header().Set(staleHeader, lastUpdated.UTC().Format(time.RFC3339))
+	return gaugeFamily("exporter_filterproxy_staleness_seconds",
+		"How long ago the served metrics were fetched, if they could not be refreshed.",
+		time.Since(lastUpdated).Seconds(),
+	)
+}
+
+// writeMetrics writes the metrics in the format negotiated through the Accept header of the request.
+// Supported formats are the Prometheus text format, delimited protobuf, and OpenMetrics.
+// The response is compressed using gzip if the client accepts it.
+func writeMetrics(w http.ResponseWriter, r *http.Request, metrics []dto.MetricFamily) {
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	var out io.Writer = w
+	if acceptsGzip(r.Header) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+
+	enc := expfmt.NewEncoder(out, format)
+	for _, fm := range metrics {
 		err := enc.Encode(&fm)
 		if err != nil && !errors.Is(err, syscall.EPIPE) {
 			log.Printf("Failed to encode: %s", err.Error())
@@ -116,4 +217,32 @@ func writeMetrics(w http.ResponseWriter, metrics []dto.MetricFamily, filterLabel
 			return
 		}
 	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		err := closer.Close()
+		if err != nil && !errors.Is(err, syscall.EPIPE) {
+			log.Printf("Failed to encode: %s", err.Error())
+		}
+	}
+}
+
+// acceptsGzip returns whether the Accept-Encoding header allows a gzip encoded response.
+func acceptsGzip(h http.Header) bool {
+	for _, enc := range strings.Split(h.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(p, "=")
+			if !ok || strings.TrimSpace(k) != "q" {
+				continue
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		return q > 0
+	}
+	return false
 }
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -27,7 +35,7 @@ func TestHandler(t *testing.T) {
 		URL:    server.URL,
 		Client: server.Client(),
 	}
-	h := handler(&f)
+	h := handler(&f, nil)
 
 	req, err := http.NewRequest("GET", "/metrics?foo=buzz", nil)
 	require.NoError(t, err)
@@ -37,79 +45,238 @@ func TestHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Equal(t, expectedHandlerRes, rr.Body.String())
 
+	req, err = http.NewRequest("GET", `/metrics?foo=~"bu.*|bl.*"&type!~".%2B"`, nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedHandlerMatcherRes, rr.Body.String())
+
+	req, err = http.NewRequest("GET", "/metrics?"+url.Values{
+		"match[]": []string{`test_metric_one{foo="bar"}`, `{__name__="test_metric_one",foo="blub"}`, `test_metric_two{type="test"}`},
+		"type!":   []string{"test"},
+	}.Encode(), nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedHandlerSelectorRes, rr.Body.String())
+
+	req, err = http.NewRequest("GET", `/metrics?foo=buzz&foo=blub&foo=two&type!=fake`, nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedHandlerMatcherRes, rr.Body.String())
+
+	req, err = http.NewRequest("GET", `/metrics?foo=~"b(.*"`, nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
 
 var expectedHandlerRes = `# HELP test_metric_one First sample metric
 # TYPE test_metric_one gauge
 test_metric_one{foo="buzz"} 0.2
 `
+var expectedHandlerSelectorRes = `# HELP test_metric_one First sample metric
+# TYPE test_metric_one gauge
+test_metric_one{foo="bar"} 0.1
+test_metric_one{foo="blub"} 0.3
+`
+var expectedHandlerMatcherRes = `# HELP test_metric_one First sample metric
+# TYPE test_metric_one gauge
+test_metric_one{foo="buzz"} 0.2
+test_metric_one{foo="blub"} 0.3
+`
 
-func TestMultiHandler(t *testing.T) {
+func TestHandlerStale(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, err := os.ReadFile("testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
 
-	h := multiHandler("/test", fakeMultiMetricsFetcher{
-		"foo": []dto.MetricFamily{
-			{
-				Name: deref("foo"),
-				Help: deref("Foo"),
-				Type: deref(dto.MetricType_GAUGE),
-				Metric: []*dto.Metric{
-					{
-						Label: []*dto.LabelPair{
-							{
-								Name:  deref("foo"),
-								Value: deref("bar"),
-							},
-						},
-						Gauge: &dto.Gauge{
-							Value: deref(float64(2)),
-						},
-					},
-					{
-						Label: []*dto.LabelPair{
-							{
-								Name:  deref("foo"),
-								Value: deref("buzz"),
-							},
-						},
-						Gauge: &dto.Gauge{
-							Value: deref(float64(3)),
-						},
-					},
-				},
-			},
+	f := target.StaticFetcher{
+		URL:          server.URL,
+		Client:       server.Client(),
+		MaxStaleness: time.Minute,
+	}
+	h := handler(&f, nil)
+
+	req, err := http.NewRequest("GET", "/metrics?foo=buzz", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get(staleHeader))
+	assert.Equal(t, expectedHandlerRes, rr.Body.String())
+
+	atomic.StoreInt32(&failing, 1)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get(staleHeader))
+	assert.True(t, strings.HasPrefix(rr.Body.String(), expectedHandlerRes), "should serve the cached metrics")
+	assert.Contains(t, rr.Body.String(), "# TYPE exporter_filterproxy_staleness_seconds gauge\n")
+}
+
+func TestHandlerFormats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, err := os.ReadFile("testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	f := target.StaticFetcher{
+		URL:    server.URL,
+		Client: server.Client(),
+	}
+	h := handler(&f, nil)
+
+	fixture, err := os.Open("testdata/simple")
+	require.NoError(t, err)
+	defer fixture.Close()
+	expected := decodeTestMetrics(t, fixture, expfmt.FmtText)
+
+	tcs := map[string]struct {
+		accept string
+		format expfmt.Format
+	}{
+		"Default": {
+			format: expfmt.FmtText,
 		},
-		"bar": []dto.MetricFamily{
-			{
-				Name: deref("bar"),
-				Help: deref("BAR"),
-				Type: deref(dto.MetricType_COUNTER),
-				Metric: []*dto.Metric{
-					{
-						Label: []*dto.LabelPair{
-							{
-								Name:  deref("foo"),
-								Value: deref("bar"),
-							},
-						},
-						Counter: &dto.Counter{
-							Value: deref(float64(42)),
-						},
-					},
-					{
-						Label: []*dto.LabelPair{
-							{
-								Name:  deref("bar"),
-								Value: deref("buzz"),
-							},
-						},
-						Counter: &dto.Counter{
-							Value: deref(float64(3)),
-						},
-					},
-				},
-			},
+		"Text": {
+			accept: "text/plain;version=0.0.4",
+			format: expfmt.FmtText,
 		},
-	})
+		"Protobuf": {
+			accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3",
+			format: expfmt.FmtProtoDelim,
+		},
+		"OpenMetrics": {
+			accept: "application/openmetrics-text;version=1.0.0;q=0.5,application/openmetrics-text;version=0.0.1;q=0.4,text/plain;version=0.0.4;q=0.3,*/*;q=0.2",
+			format: expfmt.FmtOpenMetrics,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/metrics", nil)
+			require.NoError(t, err)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Equal(t, string(tc.format), rr.Header().Get("Content-Type"))
+
+			if tc.format == expfmt.FmtOpenMetrics {
+				// expfmt can't decode OpenMetrics, so we compare the exposition directly.
+				// Counters without the `_total` suffix are exposed with the type unknown, as required by OpenMetrics.
+				assert.ElementsMatch(t, strings.Split(expectedOpenMetrics, "\n"), strings.Split(rr.Body.String(), "\n"))
+				assert.True(t, strings.HasSuffix(rr.Body.String(), "# EOF\n"))
+				return
+			}
+			actual := decodeTestMetrics(t, rr.Body, expfmt.ResponseFormat(rr.Header()))
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+var expectedOpenMetrics = `# HELP test_metric_one First sample metric
+# TYPE test_metric_one gauge
+test_metric_one{foo="bar"} 0.1
+test_metric_one{foo="buzz"} 0.2
+test_metric_one{foo="blub"} 0.3
+# HELP test_metric_two Second sample metric
+# TYPE test_metric_two unknown
+test_metric_two{foo="bar"} 1.0
+test_metric_two{foo="bar",type="test"} 2.0
+test_metric_two{foo="blub",type="fake"} 3.0
+# EOF
+`
+
+// decodeTestMetrics decodes the metrics and returns them in the text format, sorted by metric name.
+func decodeTestMetrics(t *testing.T, r io.Reader, format expfmt.Format) []string {
+	dec := expfmt.NewDecoder(r, format)
+	res := []string{}
+	for {
+		mf := dto.MetricFamily{}
+		err := dec.Decode(&mf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		buf := &strings.Builder{}
+		_, err = expfmt.MetricFamilyToText(buf, &mf)
+		require.NoError(t, err)
+		res = append(res, buf.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestHandlerGzip(t *testing.T) {
+	h := multiHandler("/test", testMultiMetricsFetcher, nil)
+
+	req, err := http.NewRequest("GET", "/test/foo?foo=buzz", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+
+	gz, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, expectedMulitHandlerFoo, string(body))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tcs := map[string]bool{
+		"":                      false,
+		"gzip":                  true,
+		"GZIP":                  true,
+		"deflate, gzip;q=1.0":   true,
+		"gzip;q=0.5, identity":  true,
+		"gzip;q=0":              false,
+		"gzip; q=0.000":         false,
+		"br, deflate":           false,
+		"identity, gzipper":     false,
+		"gzip;level=1;q=0.001":  true,
+		"deflate;q=0, gzip;q=1": true,
+	}
+	for header, expected := range tcs {
+		h := http.Header{}
+		h.Set("Accept-Encoding", header)
+		assert.Equal(t, expected, acceptsGzip(h), "Accept-Encoding: %q", header)
+	}
+}
+
+func TestMultiHandler(t *testing.T) {
+
+	h := multiHandler("/test", testMultiMetricsFetcher, nil)
 
 	req, err := http.NewRequest("GET", "/test/foo?foo=buzz", nil)
 	require.NoError(t, err)
@@ -135,6 +302,153 @@ func TestMultiHandler(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, rr.Code)
 }
 
+func TestMultiHandlerEnforced(t *testing.T) {
+
+	h := multiHandler("/test", testMultiMetricsFetcher, matcherSet{
+		testMatcher(matchEqual, "foo", "buzz"),
+	})
+
+	req, err := http.NewRequest("GET", "/test/foo", nil)
+	require.NoError(t, err)
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedMulitHandlerFoo, rr.Body.String())
+
+	// The URL parameters must not be able to widen the enforced filter
+	req, err = http.NewRequest("GET", "/test/foo?foo=bar&foo=buzz", nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, expectedMulitHandlerFoo, rr.Body.String())
+
+	req, err = http.NewRequest("GET", "/test/foo?foo=bar", nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", rr.Body.String())
+
+	req, err = http.NewRequest("GET", "/test/bar?"+url.Values{"match[]": []string{`{foo=~".+"}`}}.Encode(), nil)
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "", rr.Body.String())
+}
+
+var testMultiMetricsFetcher = fakeMultiMetricsFetcher{
+	"ns": []dto.MetricFamily{
+		{
+			Name: deref("ns"),
+			Help: deref("NS"),
+			Type: deref(dto.MetricType_GAUGE),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("namespace"),
+							Value: deref("a"),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: deref(float64(1)),
+					},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("namespace"),
+							Value: deref("b"),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: deref(float64(2)),
+					},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("namespace"),
+							Value: deref("shared"),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: deref(float64(3)),
+					},
+				},
+			},
+		},
+	},
+	"foo": []dto.MetricFamily{
+		{
+			Name: deref("foo"),
+			Help: deref("Foo"),
+			Type: deref(dto.MetricType_GAUGE),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("foo"),
+							Value: deref("bar"),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: deref(float64(2)),
+					},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("foo"),
+							Value: deref("buzz"),
+						},
+					},
+					Gauge: &dto.Gauge{
+						Value: deref(float64(3)),
+					},
+				},
+			},
+		},
+	},
+	"bar": []dto.MetricFamily{
+		{
+			Name: deref("bar"),
+			Help: deref("BAR"),
+			Type: deref(dto.MetricType_COUNTER),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("foo"),
+							Value: deref("bar"),
+						},
+					},
+					Counter: &dto.Counter{
+						Value: deref(float64(42)),
+					},
+				},
+				{
+					Label: []*dto.LabelPair{
+						{
+							Name:  deref("bar"),
+							Value: deref("buzz"),
+						},
+					},
+					Counter: &dto.Counter{
+						Value: deref(float64(3)),
+					},
+				},
+			},
+		},
+	},
+}
+
 var expectedMulitHandlerFoo = `# HELP foo Foo
 # TYPE foo gauge
 foo{foo="buzz"} 3
@@ -1,108 +1,183 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/vshn/exporter-filterproxy/target"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var kubeSAPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 
 func main() {
-	mux := http.NewServeMux()
-
 	configPath := flag.String("config", "", "path to config file")
+	checkConfig := flag.Bool("check-config", false, "validate the config file, list all problems, and exit")
 	flag.Parse()
 
-	conf, err := readConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to open configuration file %q: %s", *configPath, err.Error())
+	if *checkConfig {
+		if *configPath == "" {
+			fmt.Fprintln(os.Stderr, "--check-config requires the config file to be set with --config")
+			os.Exit(2)
+		}
+		if _, _, err := readConfig(*configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %q is valid\n", *configPath)
 		return
 	}
 
-	targetDiscovery := multiTargetConfigFetcher{}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reloader, conf, err := newReloader(ctx, *configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %s", err.Error())
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.run(ctx, hup)
 
-	for name, endpoint := range conf.Endpoints {
+	srv := &http.Server{
+		Addr:         conf.Addr,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		Handler:      reloader,
+	}
 
-		authToken, err := getAuthToken(endpoint.Auth)
+	listen := srv.ListenAndServe
+	if conf.TLSServerConfig != nil {
+		st, err := newServerTLS(*conf.TLSServerConfig)
 		if err != nil {
-			log.Fatalf("Failed to get bearer token: %s", err.Error())
+			log.Fatalf("Failed to initialize TLS: %s", err.Error())
 			return
 		}
+		srv.TLSConfig = st.TLSConfig()
+		listen = func() error {
+			return srv.ListenAndServeTLS("", "")
+		}
+		log.Printf("Listening on %s using TLS", conf.Addr)
+	} else {
+		log.Printf("Listening on %s", conf.Addr)
+	}
 
-		switch {
-		case endpoint.Target != "":
-			log.Printf("Registering static endpoint %q at %s", name, endpoint.Path)
-			sf := target.NewStaticFetcher(endpoint.Target, authToken, endpoint.RefreshInterval, endpoint.InsecureSkipVerify)
-			mux.HandleFunc(endpoint.Path,
-				handler(sf),
-			)
-			targetDiscovery[endpoint.Path] = sf
-		case endpoint.KubernetesTarget != nil:
-			log.Printf("Registering kube endpoint %q at %s", name, endpoint.Path)
-			kf, err := target.NewKubernetesEndpointFetcher(
-				target.KubernetesEndpointFetcherOpts{
-					Endpointname:       endpoint.KubernetesTarget.Endpoint.Name,
-					Namespace:          endpoint.KubernetesTarget.Endpoint.Namespace,
-					Port:               endpoint.KubernetesTarget.Endpoint.Port,
-					Path:               endpoint.KubernetesTarget.Endpoint.Path,
-					Scheme:             endpoint.KubernetesTarget.Endpoint.Scheme,
-					AuthToken:          authToken,
-					RefreshInterval:    endpoint.RefreshInterval,
-					InsecureSkipVerify: endpoint.InsecureSkipVerify,
-				},
-			)
-			if err != nil {
-				log.Fatalf("Failed to initalize Kubernetes endpoint: %s", err.Error())
-				return
-			}
-			mux.HandleFunc(endpoint.Path+"/",
-				multiHandler(endpoint.Path, kf),
-			)
-			mux.HandleFunc(endpoint.Path,
-				serviceDiscoveryHandler(endpoint.Path, kf),
-			)
-			targetDiscovery[endpoint.Path] = kf
-		default:
-			log.Fatalf("No target set for endpoint %s", name)
-			return
+	// closed once all connections are closed after shutdown
+	idle := make(chan struct{})
+	go func() {
+		defer close(idle)
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down server: %s", err.Error())
 		}
+	}()
 
+	if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+		stop()
 	}
+	<-idle
+	reloader.stop()
+}
 
-	mux.HandleFunc("/",
-		serviceDiscoveryHandler("", targetDiscovery),
-	)
+// refresher keeps the cached metrics of an endpoint up to date until the context is canceled.
+type refresher interface {
+	Run(ctx context.Context)
+}
 
-	srv := &http.Server{
-		Addr:         conf.Addr,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
-		Handler:      mux,
+// newKubernetesFetcher returns the fetcher for the Kubernetes target of the endpoint.
+func newKubernetesFetcher(ctx context.Context, endpoint endpointConfig, auth target.Authorizer, transport http.RoundTripper) (*target.KubernetesEndpointFetcher, error) {
+	if pods := endpoint.KubernetesTarget.Pods; pods != nil {
+		return target.NewKubernetesPodFetcher(ctx,
+			target.KubernetesPodFetcherOpts{
+				Namespaces:         pods.Namespaces,
+				Selector:           pods.Selector,
+				Port:               pods.Port,
+				Path:               pods.Path,
+				Scheme:             pods.Scheme,
+				AggregatePodLabel:  endpoint.KubernetesTarget.AggregatePodLabel,
+				Auth:               auth,
+				RefreshInterval:    endpoint.RefreshInterval,
+				MaxStaleness:       endpoint.MaxStaleness,
+				InsecureSkipVerify: endpoint.InsecureSkipVerify,
+				Transport:          transport,
+			},
+		)
 	}
-	log.Printf("Listening on %s", conf.Addr)
-	log.Println(srv.ListenAndServe())
+	return target.NewKubernetesEndpointFetcher(ctx,
+		target.KubernetesEndpointFetcherOpts{
+			Endpointname:       endpoint.KubernetesTarget.Endpoint.Name,
+			Namespace:          endpoint.KubernetesTarget.Endpoint.Namespace,
+			ServiceSelector:    endpoint.KubernetesTarget.Endpoint.Selector,
+			Namespaces:         endpoint.KubernetesTarget.Endpoint.Namespaces,
+			NamespaceSelector:  endpoint.KubernetesTarget.Endpoint.NamespaceSelector,
+			Port:               endpoint.KubernetesTarget.Endpoint.Port,
+			Path:               endpoint.KubernetesTarget.Endpoint.Path,
+			Scheme:             endpoint.KubernetesTarget.Endpoint.Scheme,
+			Discovery:          endpoint.KubernetesTarget.Endpoint.Discovery,
+			PodMetadata:        endpoint.KubernetesTarget.Endpoint.PodMetadata,
+			AggregatePodLabel:  endpoint.KubernetesTarget.AggregatePodLabel,
+			Auth:               auth,
+			RefreshInterval:    endpoint.RefreshInterval,
+			MaxStaleness:       endpoint.MaxStaleness,
+			InsecureSkipVerify: endpoint.InsecureSkipVerify,
+			Transport:          transport,
+		},
+	)
 }
 
-func getAuthToken(conf endpointAuth) (string, error) {
-	switch conf.Type {
-	case authModeBearer:
-		return fmt.Sprintf("Bearer %s", conf.Token), nil
-	case authModeKube:
-		saToken, err := os.ReadFile(kubeSAPath)
+// newAuthenticator returns the authenticator for incoming requests or nil if authentication is disabled.
+func newAuthenticator(conf config) (authenticator, error) {
+	auth := multiAuthenticator{}
+	if len(conf.Tenants) > 0 {
+		ta, err := newTokenAuthenticator(conf.Tenants)
 		if err != nil {
-			return "", fmt.Errorf("failed to get kubernetes serviceaccount token: %w", err)
+			return nil, fmt.Errorf("failed to initialize tenants: %w", err)
 		}
-		return fmt.Sprintf("Bearer %s", string(saToken)), nil
-	case authModeNone:
-		return "", nil
-	default:
-		return "", fmt.Errorf("unkown auth type: %q", conf.Type)
+		auth = append(auth, ta)
+	}
+	if conf.KubernetesAuth != nil {
+		restConf, err := ctrl.GetConfig()
+		if err != nil {
+			return nil, err
+		}
+		kubeClient, err := client.New(restConf, client.Options{})
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, newKubeAuthenticator(kubeClient, *conf.KubernetesAuth))
+	}
+	if conf.TLSServerConfig != nil && conf.TLSServerConfig.TenantFrom != "" {
+		ca, err := newCertAuthenticator(conf.TLSServerConfig.TenantFrom, conf.TLSServerConfig.TenantLabel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize client certificate authentication: %w", err)
+		}
+		auth = append(auth, ca)
+	}
+	if conf.JWTAuth != nil {
+		ja, err := newJWTAuthenticator(*conf.JWTAuth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize JWT authentication: %w", err)
+		}
+		auth = append(auth, ja)
+	}
+
+	if len(auth) == 0 {
+		return nil, nil
 	}
+	return auth, nil
 }
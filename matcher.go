@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+type matchType int
+
+const (
+	matchEqual matchType = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+func (t matchType) String() string {
+	switch t {
+	case matchEqual:
+		return "="
+	case matchNotEqual:
+		return "!="
+	case matchRegexp:
+		return "=~"
+	case matchNotRegexp:
+		return "!~"
+	}
+	return "?"
+}
+
+// labelMatcher matches the value of a single label, using the same semantics as Prometheus label matchers.
+// A label that is not set is treated as if it had an empty value and regular expressions are fully anchored.
+type labelMatcher struct {
+	Name  string
+	Type  matchType
+	Value string
+
+	re  *regexp.Regexp
+	set map[string]bool
+}
+
+func newLabelMatcher(t matchType, name, value string) (*labelMatcher, error) {
+	if !model.LabelName(name).IsValid() {
+		return nil, fmt.Errorf("invalid label name %q", name)
+	}
+	m := &labelMatcher{
+		Name:  name,
+		Type:  t,
+		Value: value,
+	}
+	if t == matchRegexp || t == matchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression for label %q: %w", name, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches returns whether the label value v matches the matcher.
+func (m *labelMatcher) Matches(v string) bool {
+	switch m.Type {
+	case matchEqual:
+		return v == m.Value
+	case matchNotEqual:
+		return v != m.Value
+	case matchRegexp:
+		if m.set != nil {
+			return m.set[v]
+		}
+		return m.re.MatchString(v)
+	case matchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// anyOf combines positive matchers on the same label into a single matcher that matches if *any* of them matches.
+// If all of them are equality matchers, the resulting matcher will match the values as a set.
+func anyOf(name string, ms []*labelMatcher) (*labelMatcher, error) {
+	alternatives := make([]string, 0, len(ms))
+	set := map[string]bool{}
+	isSet := true
+	for _, m := range ms {
+		switch m.Type {
+		case matchEqual:
+			alternatives = append(alternatives, regexp.QuoteMeta(m.Value))
+			set[m.Value] = true
+		case matchRegexp:
+			alternatives = append(alternatives, "(?:"+m.Value+")")
+			isSet = false
+		default:
+			return nil, fmt.Errorf("cannot combine negative matcher %s", m)
+		}
+	}
+
+	res, err := newLabelMatcher(matchRegexp, name, strings.Join(alternatives, "|"))
+	if err != nil {
+		return nil, err
+	}
+	if isSet {
+		res.set = set
+	}
+	return res, nil
+}
+
+// newSetMatcher returns a matcher that matches if the label has any of the given values.
+func newSetMatcher(name string, values []string) (*labelMatcher, error) {
+	ms := make([]*labelMatcher, 0, len(values))
+	for _, v := range values {
+		m, err := newLabelMatcher(matchEqual, name, v)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	if len(ms) == 1 {
+		return ms[0], nil
+	}
+	return anyOf(name, ms)
+}
+
+func (m *labelMatcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// matcherSet is a set of label matchers that all need to match for a metric to be selected.
+type matcherSet []*labelMatcher
+
+func (ms matcherSet) matches(name string, m *dto.Metric) bool {
+	for _, matcher := range ms {
+		v := name
+		if matcher.Name != model.MetricNameLabel {
+			v = labelValue(m, matcher.Name)
+		}
+		if !matcher.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ms matcherSet) String() string {
+	s := make([]string, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, m.String())
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
+// seriesFilter selects all metrics that match *any* of its matcher sets, the same way multiple `match[]`
+// selectors are combined by the Prometheus federation endpoint.
+// An empty seriesFilter selects all metrics.
+type seriesFilter []matcherSet
+
+func (f seriesFilter) matches(name string, m *dto.Metric) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, ms := range f {
+		if ms.matches(name, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// and returns a seriesFilter that only selects metrics that are selected by f *and* match all matchers in ms.
+func (f seriesFilter) and(ms matcherSet) seriesFilter {
+	if len(ms) == 0 {
+		return f
+	}
+	if len(f) == 0 {
+		return seriesFilter{ms}
+	}
+	res := make(seriesFilter, 0, len(f))
+	for _, fms := range f {
+		res = append(res, append(append(matcherSet{}, fms...), ms...))
+	}
+	return res
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+// parseMatcherParam parses a single URL parameter into a label matcher.
+// A key ending in `!` negates the matcher and a value starting with `~` is interpreted as regular expression,
+// so that `label=value`, `label!=value`, `label=~regex`, and `label!~regex` all work as expected.
+// The value can optionally be enclosed in double quotes.
+func parseMatcherParam(key string, value string) (*labelMatcher, error) {
+	// `label!~regex` does not contain a `=` so the whole matcher ends up in the key
+	if i := strings.Index(key, "!~"); i >= 0 {
+		if value != "" {
+			value = "=" + value
+		}
+		key, value = key[:i+1], key[i+1:]+value
+	}
+
+	t := matchEqual
+	if strings.HasSuffix(key, "!") {
+		key = strings.TrimSuffix(key, "!")
+		t = matchNotEqual
+	}
+	if strings.HasPrefix(value, "~") {
+		value = strings.TrimPrefix(value, "~")
+		if t == matchEqual {
+			t = matchRegexp
+		} else {
+			t = matchNotRegexp
+		}
+	}
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		v, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted value for label %q: %w", key, err)
+		}
+		value = v
+	}
+	return newLabelMatcher(t, key, value)
+}
+
+func sortMatchers(ms matcherSet) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Name < ms[j].Name
+	})
+}
+
+// parseSelector parses a PromQL series selector such as `kube_pod_info{namespace="x"}` or
+// `{__name__=~"kube_deployment_.*",namespace="y"}` into a set of label matchers.
+// Like in Prometheus, a selector needs to contain at least one matcher that does not match the empty string.
+func parseSelector(input string) (matcherSet, error) {
+	p := selectorParser{input: input}
+	ms, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", input, err)
+	}
+	for _, m := range ms {
+		if !m.Matches("") {
+			return ms, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid selector %q: must contain at least one non-empty matcher", input)
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) parse() (matcherSet, error) {
+	ms := matcherSet{}
+
+	p.skipSpace()
+	hasName := false
+	if name := p.identifier(true); name != "" {
+		m, err := newLabelMatcher(matchEqual, model.MetricNameLabel, name)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		hasName = true
+	}
+
+	p.skipSpace()
+	if p.peek() == '{' {
+		p.pos++
+		for {
+			p.skipSpace()
+			if p.peek() == '}' {
+				p.pos++
+				break
+			}
+
+			name := p.identifier(false)
+			if name == "" {
+				return nil, p.errorf("expected label name")
+			}
+			if name == model.MetricNameLabel && hasName {
+				return nil, p.errorf("metric name must not be set twice")
+			}
+			p.skipSpace()
+			t, err := p.matchOp()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			value, err := p.stringLiteral()
+			if err != nil {
+				return nil, err
+			}
+			m, err := newLabelMatcher(t, name, value)
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+
+			p.skipSpace()
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case '}':
+			default:
+				return nil, p.errorf("expected ',' or '}'")
+			}
+		}
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected character %q", p.peek())
+	}
+	return ms, nil
+}
+
+func (p *selectorParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *selectorParser) skipSpace() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\r\n", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// identifier consumes a label name, or a metric name if metricName is set, and returns it.
+// It returns an empty string if there is no identifier at the current position.
+func (p *selectorParser) identifier(metricName bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		isValid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(metricName && c == ':') ||
+			(p.pos > start && c >= '0' && c <= '9')
+		if !isValid {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *selectorParser) matchOp() (matchType, error) {
+	ops := []matchType{matchNotEqual, matchRegexp, matchNotRegexp, matchEqual}
+	for _, op := range ops {
+		if strings.HasPrefix(p.input[p.pos:], op.String()) {
+			p.pos += len(op.String())
+			return op, nil
+		}
+	}
+	return 0, p.errorf("expected one of '=', '!=', '=~', or '!~'")
+}
+
+// stringLiteral consumes a double quoted, single quoted, or backtick quoted string and returns its unquoted value.
+func (p *selectorParser) stringLiteral() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorf("expected string")
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch {
+		case c == '\\' && quote != '`':
+			p.pos += 2
+			continue
+		case c == quote:
+			p.pos++
+			return unquote(p.input[start:p.pos])
+		}
+		p.pos++
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *selectorParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, a...), p.pos)
+}
+
+// unquote unquotes a string literal using the PromQL quoting rules, which are the same as Go's
+// except that single quotes delimit strings as well.
+func unquote(s string) (string, error) {
+	if s[0] != '\'' {
+		return strconv.Unquote(s)
+	}
+	b := strings.Builder{}
+	b.WriteByte('"')
+	inner := s[1 : len(s)-1]
+	for i := 0; i < len(inner); i++ {
+		switch {
+		case inner[i] == '\\' && i+1 < len(inner) && inner[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case inner[i] == '\\' && i+1 < len(inner):
+			b.WriteString(inner[i : i+2])
+			i++
+		case inner[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(inner[i])
+		}
+	}
+	b.WriteByte('"')
+	return strconv.Unquote(b.String())
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatcherParam(t *testing.T) {
+
+	tcs := map[string]struct {
+		key   string
+		value string
+
+		err      bool
+		expected string
+	}{
+		"Equal": {
+			key:      "namespace",
+			value:    "foo",
+			expected: `namespace="foo"`,
+		},
+		"EqualQuoted": {
+			key:      "namespace",
+			value:    `"foo"`,
+			expected: `namespace="foo"`,
+		},
+		"EqualQuotedTilde": {
+			key:      "namespace",
+			value:    `"~foo"`,
+			expected: `namespace="~foo"`,
+		},
+		"NotEqual": {
+			key:      "namespace!",
+			value:    "foo",
+			expected: `namespace!="foo"`,
+		},
+		"Regexp": {
+			key:      "namespace",
+			value:    `~"team-a-.*"`,
+			expected: `namespace=~"team-a-.*"`,
+		},
+		"RegexpUnquoted": {
+			key:      "namespace",
+			value:    `~team-a-.*`,
+			expected: `namespace=~"team-a-.*"`,
+		},
+		"NotRegexp": {
+			key:      "namespace!",
+			value:    `~"team-a-.*"`,
+			expected: `namespace!~"team-a-.*"`,
+		},
+		"NotRegexpNoEqual": {
+			key:      `namespace!~"team-a-.*"`,
+			value:    "",
+			expected: `namespace!~"team-a-.*"`,
+		},
+		"NotRegexpNoEqualSplit": {
+			key:      `namespace!~"team-a-(b`,
+			value:    `c)"`,
+			expected: `namespace!~"team-a-(b=c)"`,
+		},
+		"InvalidRegexp": {
+			key:   "namespace",
+			value: `~"team-a-(.*"`,
+			err:   true,
+		},
+		"InvalidLabel": {
+			key:   "name-space",
+			value: "foo",
+			err:   true,
+		},
+		"InvalidQuote": {
+			key:   "namespace",
+			value: `"fo"o"`,
+			err:   true,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			m, err := parseMatcherParam(tc.key, tc.value)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, m.String())
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+
+	tcs := map[string]struct {
+		input string
+
+		err      bool
+		expected string
+	}{
+		"MetricName": {
+			input:    "kube_pod_info",
+			expected: `{__name__="kube_pod_info"}`,
+		},
+		"MetricNameAndLabels": {
+			input:    `kube_pod_info{namespace="x", pod!~'a.*'}`,
+			expected: `{__name__="kube_pod_info",namespace="x",pod!~"a.*"}`,
+		},
+		"Labels": {
+			input:    ` { __name__=~"kube_deployment_.*" , namespace != ` + "`y`" + `, } `,
+			expected: `{__name__=~"kube_deployment_.*",namespace!="y"}`,
+		},
+		"Escapes": {
+			input:    `{foo="a\"b", bar='c\'d"e'}`,
+			expected: `{foo="a\"b",bar="c'd\"e"}`,
+		},
+		"RecordingRule": {
+			input:    `namespace:container_cpu:sum`,
+			expected: `{__name__="namespace:container_cpu:sum"}`,
+		},
+		"EmptyMatchersOnly": {
+			input: `{namespace=~".*"}`,
+			err:   true,
+		},
+		"Empty": {
+			input: ``,
+			err:   true,
+		},
+		"NameTwice": {
+			input: `foo{__name__="bar"}`,
+			err:   true,
+		},
+		"Unterminated": {
+			input: `foo{bar="buzz}`,
+			err:   true,
+		},
+		"MissingComma": {
+			input: `foo{bar="buzz" a="b"}`,
+			err:   true,
+		},
+		"InvalidOperator": {
+			input: `foo{bar=="buzz"}`,
+			err:   true,
+		},
+		"TrailingGarbage": {
+			input: `foo{bar="buzz"}[5m]`,
+			err:   true,
+		},
+		"InvalidRegexp": {
+			input: `foo{bar=~"(buzz"}`,
+			err:   true,
+		},
+		// The following cases pin the behavior of the parser to the one of promql/parser.ParseMetricSelector
+		"EscapeSequences": {
+			input:    `{a="\u00fc\x41\101\t", b='\'\\'}`,
+			expected: `{a="üAA\t",b="'\\"}`,
+		},
+		"RawString": {
+			input:    "{a=~`\\d+\\.\\d+`}",
+			expected: `{a=~"\\d+\\.\\d+"}`,
+		},
+		"InvalidEscape": {
+			input: `{a="\q"}`,
+			err:   true,
+		},
+		"NewlineInString": {
+			input: "{a=\"b\nc\"}",
+			err:   true,
+		},
+		"UnicodeValue": {
+			input:    `{city="Zürich", emoji=~"🙂|🙃"}`,
+			expected: `{city="Zürich",emoji=~"🙂|🙃"}`,
+		},
+		"UnicodeLabelName": {
+			input: `{zürich="x"}`,
+			err:   true,
+		},
+		"UnicodeMetricName": {
+			input: `zürich_total`,
+			err:   true,
+		},
+		"NameInBraces": {
+			input:    `{job="x", __name__="foo"}`,
+			expected: `{job="x",__name__="foo"}`,
+		},
+		"NameTwiceInBraces": {
+			input:    `{__name__="foo", __name__!="bar"}`,
+			expected: `{__name__="foo",__name__!="bar"}`,
+		},
+		"NameAndNameMatcher": {
+			input: `foo{__name__!="bar"}`,
+			err:   true,
+		},
+		"EmptyBraces": {
+			input:    `foo{}`,
+			expected: `{__name__="foo"}`,
+		},
+		"OnlyBraces": {
+			input: `{}`,
+			err:   true,
+		},
+		"TrailingComma": {
+			input:    `foo{a="b",}`,
+			expected: `{__name__="foo",a="b"}`,
+		},
+		"OnlyComma": {
+			input: `foo{,}`,
+			err:   true,
+		},
+		"DoubleComma": {
+			input: `foo{a="b",,}`,
+			err:   true,
+		},
+		"LeadingDigit": {
+			input: `foo{1a="b"}`,
+			err:   true,
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			ms, err := parseSelector(tc.input)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, ms.String())
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/vshn/exporter-filterproxy/target"
+	"google.golang.org/protobuf/proto"
+)
+
+// reloadMetricsPath serves the metrics about configuration reloads.
+// Requests are authenticated like the service discovery of all endpoints, using the current configuration.
+const reloadMetricsPath = "/-/metrics"
+
+// configWatchDelay is how long we wait after a change of the configuration file before reloading it.
+// Kubernetes updates mounted ConfigMaps through multiple renames, which should only cause a single reload.
+const configWatchDelay = time.Second
+
+// generation serves the endpoints of one version of the configuration.
+type generation struct {
+	handler http.Handler
+	// auth authenticates the requests for the reload metrics, nil if authentication is disabled
+	auth authenticator
+	// cancel stops the watches and background refreshes of the fetchers
+	cancel     context.CancelFunc
+	refreshers *sync.WaitGroup
+	// inflight is read locked while a request is served, so that the generation is only stopped once they are done
+	inflight sync.RWMutex
+}
+
+func (g *generation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.inflight.RLock()
+	defer g.inflight.RUnlock()
+	g.handler.ServeHTTP(w, r)
+}
+
+// stop waits for the requests that are being served and stops the fetchers of the generation.
+func (g *generation) stop() {
+	g.inflight.Lock()
+	defer g.inflight.Unlock()
+	g.cancel()
+	g.refreshers.Wait()
+}
+
+// newGeneration builds the fetchers and handlers of all endpoints of the configuration.
+// The fetchers run until ctx is canceled or the generation is stopped.
+func newGeneration(ctx context.Context, conf config) (*generation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	g := &generation{
+		cancel:     cancel,
+		refreshers: &sync.WaitGroup{},
+	}
+	if err := g.build(ctx, conf); err != nil {
+		cancel()
+		g.refreshers.Wait()
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *generation) build(ctx context.Context, conf config) error {
+	auth, err := newAuthenticator(conf)
+	if err != nil {
+		return fmt.Errorf("failed to initialize authentication: %w", err)
+	}
+
+	runRefresher := func(name string, r refresher) {
+		log.Printf("Refreshing endpoint %q in the background", name)
+		g.refreshers.Add(1)
+		go func() {
+			defer g.refreshers.Done()
+			r.Run(ctx)
+		}()
+	}
+
+	mux := http.NewServeMux()
+	targetDiscovery := multiTargetConfigFetcher{}
+
+	for name, endpoint := range conf.Endpoints {
+		if endpoint.BackgroundRefresh && endpoint.RefreshInterval <= 0 {
+			return fmt.Errorf("endpoint %q enables background_refresh without a refresh_interval", name)
+		}
+
+		authorizer, err := newAuthorizer(endpoint.Auth)
+		if err != nil {
+			return fmt.Errorf("failed to get credentials of endpoint %q: %w", name, err)
+		}
+		// transport stays nil without a tls_config, so that the fetchers use their default transport
+		var transport http.RoundTripper
+		if endpoint.TLSConfig != nil {
+			ct, err := newClientTLS(*endpoint.TLSConfig, endpoint.InsecureSkipVerify)
+			if err != nil {
+				return fmt.Errorf("failed to load TLS configuration of endpoint %q: %w", name, err)
+			}
+			transport = ct
+		}
+		enforced, err := endpoint.enforcedMatchers()
+		if err != nil {
+			return fmt.Errorf("failed to parse enforced labels of endpoint %q: %w", name, err)
+		}
+
+		switch {
+		case endpoint.Target != "":
+			log.Printf("Registering static endpoint %q at %s", name, endpoint.Path)
+			sf := target.NewStaticFetcher(endpoint.Target, authorizer, endpoint.RefreshInterval, endpoint.InsecureSkipVerify)
+			sf.MaxStaleness = endpoint.MaxStaleness
+			if transport != nil {
+				sf.Client.Transport = transport
+			}
+			mux.Handle(endpoint.Path,
+				authenticate(name, auth, handler(sf, enforced)),
+			)
+			targetDiscovery[endpoint.Path] = endpointTargetConfigFetcher{name, sf}
+			if endpoint.BackgroundRefresh {
+				runRefresher(name, sf)
+			}
+		case endpoint.KubernetesTarget != nil:
+			log.Printf("Registering kube endpoint %q at %s", name, endpoint.Path)
+			kf, err := newKubernetesFetcher(ctx, endpoint, authorizer, transport)
+			if err != nil {
+				return fmt.Errorf("failed to initalize Kubernetes endpoint %q: %w", name, err)
+			}
+			mux.Handle(endpoint.Path+"/",
+				authenticate(name, auth, multiHandler(endpoint.Path, kf, enforced)),
+			)
+			if endpoint.KubernetesTarget.Aggregate {
+				mux.Handle(endpoint.Path,
+					authenticate(name, auth, handler(kf, enforced)),
+				)
+				targetDiscovery[endpoint.Path] = endpointTargetConfigFetcher{name, aggregatedTargetConfigFetcher{}}
+			} else {
+				mux.Handle(endpoint.Path,
+					authenticate(name, auth, serviceDiscoveryHandler(endpoint.Path, kf)),
+				)
+				targetDiscovery[endpoint.Path] = endpointTargetConfigFetcher{name, kf}
+			}
+			if endpoint.BackgroundRefresh {
+				runRefresher(name, kf)
+			}
+		default:
+			return fmt.Errorf("no target set for endpoint %q", name)
+		}
+	}
+
+	mux.Handle("/",
+		authenticate("", auth, serviceDiscoveryHandler("", targetDiscovery)),
+	)
+	g.handler = mux
+	g.auth = auth
+	return nil
+}
+
+// reloader serves the endpoints of the current configuration and replaces them if the configuration changes.
+// Requests that are being served while the configuration is reloaded are completed by the previous configuration.
+type reloader struct {
+	path string
+	// ctx limits the lifetime of all generations
+	ctx context.Context
+
+	current atomic.Pointer[generation]
+
+	// mutex protects the fields below. It's not held while a generation is built, so that the metrics are still served.
+	mutex sync.Mutex
+	conf  config
+	// raw is the content of the configuration file the current generation was built from
+	raw []byte
+	// started counts the started reloads and applied is the number of the reload that built the current generation,
+	// so that a slow reload doesn't replace the generation of a reload that started later
+	started         int
+	applied         int
+	reloads         int
+	failures        int
+	lastSuccessful  bool
+	lastSuccessTime time.Time
+}
+
+// newReloader loads the configuration at path and builds the first generation of handlers.
+func newReloader(ctx context.Context, path string) (*reloader, config, error) {
+	r := &reloader{
+		path: path,
+		ctx:  ctx,
+	}
+	raw, conf, err := readConfig(path)
+	if err != nil {
+		return nil, config{}, fmt.Errorf("failed to open configuration file %q: %w", path, err)
+	}
+	g, err := newGeneration(ctx, conf)
+	if err != nil {
+		return nil, config{}, err
+	}
+	r.current.Store(g)
+	r.conf = conf
+	r.raw = raw
+	r.lastSuccessful = true
+	r.lastSuccessTime = time.Now()
+	return r, conf, nil
+}
+
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g := r.current.Load()
+	if req.URL.Path == reloadMetricsPath {
+		authenticate("", g.auth, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			writeMetrics(w, req, r.metrics())
+		})).ServeHTTP(w, req)
+		return
+	}
+	g.ServeHTTP(w, req)
+}
+
+// reload loads the configuration file and replaces the current generation of handlers with one built from it.
+// Unless force is set, the configuration is only reloaded if the file changed.
+// If the configuration is invalid, the current generation is kept.
+// The new generation is built without holding the lock. If reloads overlap, the one that started last wins.
+func (r *reloader) reload(force bool) error {
+	r.mutex.Lock()
+	r.started++
+	seq := r.started
+	current := r.raw
+	// addr and tls_server_config never change after the start, so they can be used without holding the lock
+	addr, tlsServerConfig := r.conf.Addr, r.conf.TLSServerConfig
+	r.mutex.Unlock()
+
+	raw, conf, err := readConfig(r.path)
+	if err == nil && !force && bytes.Equal(raw, current) {
+		return nil
+	}
+	var g *generation
+	if err == nil {
+		// The authentication depends on tls_server_config, so it needs to be restored before the generation is built
+		if conf.Addr != addr || !reflect.DeepEqual(conf.TLSServerConfig, tlsServerConfig) {
+			log.Printf("Changes of addr and tls_server_config require a restart and are ignored")
+			conf.Addr = addr
+			conf.TLSServerConfig = tlsServerConfig
+		}
+		g, err = newGeneration(r.ctx, conf)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reloads++
+	if err != nil {
+		r.failures++
+		r.lastSuccessful = false
+		return err
+	}
+	if seq < r.applied {
+		log.Printf("Configuration was reloaded in the meantime, discarding the outdated one")
+		go g.stop()
+		return nil
+	}
+	r.applied = seq
+
+	old := r.current.Swap(g)
+	go old.stop()
+	r.conf = conf
+	r.raw = raw
+	r.lastSuccessful = true
+	r.lastSuccessTime = time.Now()
+	return nil
+}
+
+// stop stops the current generation. It needs to be called once the server is shut down.
+func (r *reloader) stop() {
+	r.current.Load().stop()
+}
+
+// run reloads the configuration on SIGHUP and if the configuration file changes until ctx is canceled.
+func (r *reloader) run(ctx context.Context, hup <-chan os.Signal) {
+	changed := make(chan struct{}, 1)
+	if r.path != "" {
+		if err := watchFile(ctx, r.path, changed); err != nil {
+			log.Printf("Failed to watch configuration file, it's only reloaded on SIGHUP: %s", err.Error())
+		}
+	}
+
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			force = true
+		case <-changed:
+		}
+		if err := r.reload(force); err != nil {
+			log.Printf("Failed to reload configuration, keeping the previous one: %s", err.Error())
+			continue
+		}
+		log.Printf("Configuration is up to date")
+	}
+}
+
+// metrics returns the metrics about configuration reloads.
+func (r *reloader) metrics() []dto.MetricFamily {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	successful := 0.0
+	if r.lastSuccessful {
+		successful = 1
+	}
+	return []dto.MetricFamily{
+		gaugeFamily("exporter_filterproxy_config_last_reload_successful", "Whether the last configuration reload succeeded.", successful),
+		gaugeFamily("exporter_filterproxy_config_last_reload_success_timestamp_seconds", "Timestamp of the last successful configuration reload.",
+			float64(r.lastSuccessTime.UnixNano())/1e9),
+		counterFamily("exporter_filterproxy_config_reloads_total", "Number of configuration reloads.", float64(r.reloads)),
+		counterFamily("exporter_filterproxy_config_reload_failures_total", "Number of failed configuration reloads.", float64(r.failures)),
+	}
+}
+
+func gaugeFamily(name string, help string, value float64) dto.MetricFamily {
+	return dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(value)}},
+		},
+	}
+}
+
+func counterFamily(name string, help string, value float64) dto.MetricFamily {
+	return dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{Counter: &dto.Counter{Value: proto.Float64(value)}},
+		},
+	}
+}
+
+// watchFile notifies changed if the file at path changes, until ctx is canceled.
+// The directory of the file is watched, as mounted ConfigMaps are updated by replacing a symlink.
+// Notifications are delayed by configWatchDelay, so that a burst of changes only results in one notification.
+func watchFile(ctx context.Context, path string, changed chan<- struct{}) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		var delay <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				delay = time.After(configWatchDelay)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Failed to watch configuration file: %s", err.Error())
+			case <-delay:
+				delay = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return nil
+}
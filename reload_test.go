@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		data, err := os.ReadFile("testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, path, fmt.Sprintf("endpoints:\n  a:\n    path: /a\n    target: %s\n", server.URL))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, conf, err := newReloader(ctx, path)
+	require.NoError(t, err)
+	assert.Equal(t, ":80", conf.Addr)
+	defer r.stop()
+
+	assert.Equal(t, http.StatusOK, serveTestRequest(r, "/a").Code)
+	assert.NotContains(t, serveTestRequest(r, "/").Body.String(), "/b")
+
+	// Unchanged configurations are not reloaded
+	require.NoError(t, r.reload(false))
+	assert.Contains(t, serveTestRequest(r, reloadMetricsPath).Body.String(), "exporter_filterproxy_config_reloads_total 0")
+
+	writeTestConfig(t, path, fmt.Sprintf("endpoints:\n  b:\n    path: /b\n    target: %s\n", server.URL))
+	require.NoError(t, r.reload(false))
+	assert.Contains(t, serveTestRequest(r, "/").Body.String(), "/b")
+	assert.Contains(t, serveTestRequest(r, "/b").Body.String(), "test_metric_one")
+
+	// Invalid configurations keep the previous one
+	writeTestConfig(t, path, "endpoints:\n  c:\n    path: /c\n")
+	require.Error(t, r.reload(false))
+	assert.Contains(t, serveTestRequest(r, "/b").Body.String(), "test_metric_one")
+
+	metrics := serveTestRequest(r, reloadMetricsPath).Body.String()
+	assert.Contains(t, metrics, "exporter_filterproxy_config_last_reload_successful 0")
+	assert.Contains(t, metrics, "exporter_filterproxy_config_reloads_total 2")
+	assert.Contains(t, metrics, "exporter_filterproxy_config_reload_failures_total 1")
+
+	writeTestConfig(t, path, fmt.Sprintf("addr: :8080\nendpoints:\n  b:\n    path: /b\n    target: %s\n", server.URL))
+	require.NoError(t, r.reload(true))
+	assert.Contains(t, serveTestRequest(r, reloadMetricsPath).Body.String(), "exporter_filterproxy_config_last_reload_successful 1")
+	assert.Equal(t, ":80", r.conf.Addr, "the address can't be changed without a restart")
+}
+
+func TestReloader_TLSServerConfig(t *testing.T) {
+	tlsConf := "tls_server_config:\n  cert_file: tls.crt\n  key_file: tls.key\n  client_ca_file: ca.crt\n"
+	tenantFrom := "  tenant_from: CN\n  tenant_label: namespace\n"
+	tcs := map[string]struct {
+		initial  string
+		reloaded string
+		code     int
+	}{
+		"RemoveTenantFrom": {
+			initial:  tlsConf + tenantFrom,
+			reloaded: tlsConf,
+			code:     http.StatusUnauthorized,
+		},
+		"AddTenantFrom": {
+			initial:  tlsConf,
+			reloaded: tlsConf + tenantFrom,
+			code:     http.StatusOK,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+			writeTestConfig(t, path, tc.initial)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r, _, err := newReloader(ctx, path)
+			require.NoError(t, err)
+			defer r.stop()
+			assert.Equal(t, tc.code, serveTestRequest(r, "/").Code)
+
+			writeTestConfig(t, path, tc.reloaded)
+			require.NoError(t, r.reload(false))
+			assert.Equal(t, tc.code, serveTestRequest(r, "/").Code, "the authentication should not change until a restart")
+		})
+	}
+}
+
+func TestReloader_MetricsAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	writeTestConfig(t, path, "tenants:\n  a:\n    token: secret\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _, err := newReloader(ctx, path)
+	require.NoError(t, err)
+	defer r.stop()
+
+	assert.Equal(t, http.StatusUnauthorized, serveTestRequest(r, reloadMetricsPath).Code)
+
+	req := httptest.NewRequest(http.MethodGet, reloadMetricsPath, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "exporter_filterproxy_config_reloads_total 0")
+}
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	writeTestConfig(t, path, "addr: :80\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	require.NoError(t, watchFile(ctx, path, changed))
+
+	// Simulate the symlink swap Kubernetes uses to update mounted ConfigMaps
+	writeTestConfig(t, filepath.Join(dir, "config.yml.new"), "addr: :8080\n")
+	require.NoError(t, os.Rename(filepath.Join(dir, "config.yml.new"), path))
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change of the configuration file was not detected")
+	}
+}
+
+func writeTestConfig(t *testing.T, path string, conf string) {
+	require.NoError(t, os.WriteFile(path, []byte(conf), 0o600))
+}
+
+func serveTestRequest(h http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
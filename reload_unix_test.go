@@ -0,0 +1,67 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloader_MetricsWhileBuilding(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	writeTestConfig(t, path, "endpoints:\n  a:\n    path: /a\n    target: http://127.0.0.1:9100\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _, err := newReloader(ctx, path)
+	require.NoError(t, err)
+	defer r.stop()
+
+	// Reading the token from a FIFO blocks the build of the generation until it's written
+	token := filepath.Join(dir, "token")
+	require.NoError(t, syscall.Mkfifo(token, 0o600))
+	writeTestConfig(t, path, fmt.Sprintf("endpoints:\n  b:\n    path: /b\n    target: http://127.0.0.1:9100\n    auth:\n      type: Bearer\n      token_file: %s\n", token))
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- r.reload(false)
+	}()
+
+	// Opening the FIFO without blocking only succeeds once the reload reads it
+	var w *os.File
+	require.Eventually(t, func() bool {
+		w, err = os.OpenFile(token, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		return err == nil
+	}, 5*time.Second, time.Millisecond, "the reload should read the token")
+
+	served := make(chan int)
+	go func() {
+		served <- serveTestRequest(r, reloadMetricsPath).Code
+	}()
+	select {
+	case code := <-served:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reload metrics were blocked by the reload")
+	}
+
+	_, err = w.WriteString("secret")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	select {
+	case err := <-reloaded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reload did not finish")
+	}
+	assert.Contains(t, serveTestRequest(r, "/").Body.String(), "/b")
+}
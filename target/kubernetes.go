@@ -3,19 +3,26 @@ package target
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
-	"golang.org/x/sync/errgroup"
-
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/model"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -23,43 +30,167 @@ type KubernetesEndpointFetcher struct {
 	endpointname string
 	namespace    string
 
-	port   int
+	// port is the name or number of the port of the service that exposes the metrics
+	port   string
 	path   string
 	scheme string
 
-	client    *http.Client
-	authToken string
+	// discovery is one of DiscoveryEndpoints, DiscoveryEndpointSlices, or DiscoveryPods
+	discovery string
+
+	// namespaces, namespaceSelector, and serviceSelector select the services if services are selected through a label selector
+	namespaces        []string
+	namespaceSelector labels.Selector
+	serviceSelector   labels.Selector
+
+	// podNamespaces, podSelector, and podPort select the pods to scrape if discovery is DiscoveryPods
+	podNamespaces []string
+	podSelector   labels.Selector
+	podPort       string
+
+	// podMetadata adds the meta labels of the pods backing the endpoints of services
+	podMetadata bool
+	// aggregatePodLabel is the label the name of the pod is added as when aggregating, if set
+	aggregatePodLabel string
+
+	client *http.Client
+	auth   Authorizer
 
-	kube client.Client
+	// kube is backed by an informer, so that discovery is served from memory
+	kube client.Reader
+
+	maxStaleness time.Duration
 
 	clock           func() time.Time
 	refreshInterval time.Duration
 	mutex           sync.Mutex
-	cache           map[string][]dto.MetricFamily
-	lastUpdated     time.Time
+	// cache holds the metrics of every discovered endpoint by its ID
+	cache map[string]*endpointCache
+	// background is set while Run keeps the cache up to date
+	background bool
+}
+
+// discoveredTarget is an exporter discovered in Kubernetes.
+type discoveredTarget struct {
+	// id identifies the target in the path of the request
+	id   string
+	ip   string
+	port int
+	// labels are added to the target in the service discovery response
+	labels model.LabelSet
+	// pod is the pod backing the target, if known
+	pod *types.NamespacedName
 }
 
+// endpointCache holds the cached metrics of a single endpoint.
+// Every endpoint is refreshed independently, so that a failing endpoint doesn't affect the others.
+type endpointCache struct {
+	// addr is the URL the metrics are fetched from
+	addr string
+	// instance and pod identify the series of the endpoint if the metrics of all endpoints are aggregated
+	instance string
+	pod      string
+
+	mutex       sync.Mutex
+	metrics     []dto.MetricFamily
+	lastUpdated time.Time
+	// lastErr is the error of the last refresh, if it failed
+	lastErr error
+	// retrying is set while a failed refresh is retried in the background
+	retrying bool
+}
+
+const (
+	// DiscoveryEndpoints discovers the endpoints of a service through its Endpoints object
+	DiscoveryEndpoints = "endpoints"
+	// DiscoveryEndpointSlices discovers the endpoints of a service through its EndpointSlices
+	DiscoveryEndpointSlices = "endpointslices"
+	// DiscoveryPods discovers pods through a label selector
+	DiscoveryPods = "pods"
+)
+
+// cacheSyncTimeout limits how long we wait for the initial list of the watched objects.
+const cacheSyncTimeout = time.Minute
+
+// getRESTConfig returns the configuration of the API server whose objects are watched.
+var getRESTConfig = ctrl.GetConfig
+
 type KubernetesEndpointFetcherOpts struct {
 	Endpointname string
 	Namespace    string
 
-	Port   int
+	// ServiceSelector selects services through a label selector instead of by name.
+	// The services are discovered in Namespace, Namespaces, or the namespaces matching NamespaceSelector.
+	// If none of them are set, services are discovered in all namespaces.
+	ServiceSelector   string
+	Namespaces        []string
+	NamespaceSelector string
+
+	// Port is the name or number of the port of the service that exposes the metrics.
+	// The number of a named port is resolved for every subset or EndpointSlice, as they can map the name to different numbers.
+	Port   string
 	Path   string
 	Scheme string
-
-	AuthToken          string
+	// Discovery is either DiscoveryEndpoints or DiscoveryEndpointSlices. Defaults to DiscoveryEndpoints.
+	Discovery string
+	// PodMetadata watches the pods backing the endpoints, so that their labels and annotations can be added to the
+	// targets in the service discovery response.
+	PodMetadata bool
+	// AggregatePodLabel is the label the name of the pod is added as to every series when aggregating.
+	// If empty, only the `instance` label is added.
+	AggregatePodLabel string
+
+	Auth               Authorizer
 	RefreshInterval    time.Duration
+	MaxStaleness       time.Duration
 	InsecureSkipVerify bool
+	// Transport is used for the requests to the exporters if set. InsecureSkipVerify is ignored in this case.
+	Transport http.RoundTripper
 }
 
-func NewKubernetesEndpointFetcher(opts KubernetesEndpointFetcherOpts) (*KubernetesEndpointFetcher, error) {
-	restConf, err := ctrl.GetConfig()
-	if err != nil {
-		return nil, err
+// NewKubernetesEndpointFetcher returns a fetcher for the endpoints of a Kubernetes service,
+// or of all services that match the ServiceSelector.
+// The Endpoints or EndpointSlices of the services are watched until ctx is canceled.
+func NewKubernetesEndpointFetcher(ctx context.Context, opts KubernetesEndpointFetcherOpts) (*KubernetesEndpointFetcher, error) {
+	discovery := opts.Discovery
+	if discovery == "" {
+		discovery = DiscoveryEndpoints
+	}
+	var watched client.Object
+	switch discovery {
+	case DiscoveryEndpoints:
+		watched = &corev1.Endpoints{}
+	case DiscoveryEndpointSlices:
+		watched = &discoveryv1.EndpointSlice{}
+	default:
+		return nil, fmt.Errorf("unknown discovery %q, must be %q or %q", discovery, DiscoveryEndpoints, DiscoveryEndpointSlices)
+	}
+
+	objs := []client.Object{watched}
+	if opts.PodMetadata {
+		objs = append(objs, &corev1.Pod{})
+	}
+	if opts.ServiceSelector != "" {
+		return newKubernetesServicesFetcher(ctx, opts, discovery, objs)
 	}
-	kubeClient, err := client.New(restConf, client.Options{})
+	if opts.Endpointname == "" {
+		return nil, errors.New("either a service name or a service selector needs to be set")
+	}
+
+	// Only watch the objects of the service, so that we don't need access to any other objects
+	kubeCache, err := watch(ctx, cache.New, cache.Options{
+		Namespace: opts.Namespace,
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Endpoints{}: {
+				Field: fields.OneTermEqualSelector("metadata.name", opts.Endpointname),
+			},
+			&discoveryv1.EndpointSlice{}: {
+				Label: labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: opts.Endpointname}),
+			},
+		},
+	}, objs...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to watch endpoints %s/%s: %w", opts.Namespace, opts.Endpointname, err)
 	}
 
 	return &KubernetesEndpointFetcher{
@@ -68,79 +199,261 @@ func NewKubernetesEndpointFetcher(opts KubernetesEndpointFetcherOpts) (*Kubernet
 		port:         opts.Port,
 		path:         opts.Path,
 		scheme:       opts.Scheme,
+		discovery:    discovery,
+		podMetadata:  opts.PodMetadata,
 
-		client: &http.Client{
-			Timeout: 5 * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: opts.InsecureSkipVerify,
-				},
-			},
-		},
-		authToken: opts.AuthToken,
+		aggregatePodLabel: opts.AggregatePodLabel,
 
-		kube: kubeClient,
+		client: newKubernetesHTTPClient(opts.InsecureSkipVerify, opts.Transport),
+		auth:   opts.Auth,
+
+		kube: kubeCache,
+
+		maxStaleness: opts.MaxStaleness,
 
 		refreshInterval: opts.RefreshInterval,
 		mutex:           sync.Mutex{},
-		cache:           map[string][]dto.MetricFamily{},
-		lastUpdated:     time.Time{},
+		cache:           map[string]*endpointCache{},
 	}, nil
 }
 
+// watch creates a cache using newCache, starts an informer for every object, and waits for them to sync.
+// The informers run until ctx is canceled.
+func watch(ctx context.Context, newCache cache.NewCacheFunc, opts cache.Options, objs ...client.Object) (cache.Cache, error) {
+	restConf, err := getRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubeCache, err := newCache(restConf, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Register the informers before starting the cache, so that we wait for them to sync
+	for _, obj := range objs {
+		if _, err := kubeCache.GetInformer(ctx, obj); err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		if err := kubeCache.Start(ctx); err != nil {
+			log.Printf("Failed to watch Kubernetes objects: %s", err.Error())
+		}
+	}()
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !kubeCache.WaitForCacheSync(syncCtx) {
+		return nil, errors.New("timed out waiting for the cache to sync")
+	}
+	return kubeCache, nil
+}
+
+func newKubernetesHTTPClient(insecureSkipVerify bool, transport http.RoundTripper) *http.Client {
+	if transport == nil {
+		transport = NewTransport(&tls.Config{
+			InsecureSkipVerify: insecureSkipVerify,
+		})
+	}
+	return &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: transport,
+	}
+}
+
+// FetchMetricsFor returns the metrics of the endpoint with the given ID, or nil if there is no such endpoint.
+// The ID of an endpoint is its IP, or `<namespace>/<service>/<ip>` if services are selected through a label selector.
+// Only the requested endpoint is queried and its metrics are cached for the refreshInterval.
+// While Run is running, the last successfully fetched metrics are returned without querying the upstream exporter.
+//
+// If the exporter can't be reached, the last successfully fetched metrics are returned together with a *StaleError,
+// as long as they are not older than the configured maximum staleness. The fetch is then retried in the background.
 func (f *KubernetesEndpointFetcher) FetchMetricsFor(ctx context.Context, endpoint string) ([]dto.MetricFamily, error) {
+	background, e, err := f.lookup(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, nil
+	}
+	return f.fetchEntry(ctx, endpoint, background, e)
+}
+
+// fetchEntry returns the metrics of the cache entry of the endpoint, fetching them if they are not cached.
+// If background is set, the cached metrics are returned as soon as the entry was refreshed once.
+func (f *KubernetesEndpointFetcher) fetchEntry(ctx context.Context, endpoint string, background bool, e *endpointCache) ([]dto.MetricFamily, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if background && (!e.lastUpdated.IsZero() || e.lastErr != nil) {
+		return f.cached(e)
+	}
+	if !e.lastUpdated.IsZero() && f.now().Sub(e.lastUpdated) < f.refreshInterval {
+		return e.metrics, nil
+	}
+	if e.retrying {
+		// Don't block on the upstream exporter while it's being retried
+		return f.cached(e)
+	}
+
+	metrics, err := fetchMetrics(ctx, f.client, e.addr, f.auth)
+	if err != nil {
+		if f.maxStaleness <= 0 || e.lastUpdated.IsZero() || f.now().Sub(e.lastUpdated) > f.maxStaleness {
+			return nil, err
+		}
+		e.lastErr = err
+		e.retrying = true
+		go f.retry(endpoint, e)
+		return f.cached(e)
+	}
+
+	e.metrics = metrics
+	e.lastUpdated = f.now()
+	e.lastErr = nil
+	return metrics, nil
+}
+
+// lookup returns the cache entry of the endpoint with the given ID, or nil if there is no such endpoint.
+// While Run is running, the entries it discovered are used. Otherwise the endpoints are discovered first.
+func (f *KubernetesEndpointFetcher) lookup(ctx context.Context, endpoint string) (bool, *endpointCache, error) {
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
+	background := f.background
+	e := f.cache[endpoint]
+	f.mutex.Unlock()
+	if background && e != nil {
+		return background, e, nil
+	}
 
-	if f.now().Sub(f.lastUpdated) < f.refreshInterval {
-		return f.cache[endpoint], nil
+	entries, err := f.discoverEntries(ctx)
+	if err != nil {
+		return background, nil, err
 	}
+	return background, entries[endpoint], nil
+}
 
-	endpoints, err := f.discover(ctx)
+// discoverEntries discovers the endpoints and returns their cache entries.
+// Entries of endpoints that disappeared are evicted from the cache.
+func (f *KubernetesEndpointFetcher) discoverEntries(ctx context.Context) (map[string]*endpointCache, error) {
+	targets, err := f.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	g, _ := errgroup.WithContext(ctx)
-	m := sync.Mutex{}
-	for _, ip := range endpoints {
-		ip := ip
-		g.Go(func() error {
-			metrics, err := fetchMetrics(f.client, f.buildAddr(ip), f.authToken)
-			if err != nil {
-				return err
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	entries := make(map[string]*endpointCache, len(targets))
+	for _, t := range targets {
+		addr := f.buildAddr(t)
+		pod := string(t.labels[metaLabelPrefix+"pod_name"])
+		e, ok := f.cache[t.id]
+		if !ok || e.addr != addr || e.pod != pod {
+			e = &endpointCache{addr: addr, instance: t.ip, pod: pod}
+		}
+		entries[t.id] = e
+	}
+	f.cache = entries
+	return entries, nil
+}
+
+// cached returns the cached metrics of the endpoint. The caller needs to hold the lock of the entry.
+// If the last refresh failed, they are returned together with a *StaleError, or not at all if they are older than the
+// maximum staleness.
+func (f *KubernetesEndpointFetcher) cached(e *endpointCache) ([]dto.MetricFamily, error) {
+	if e.lastErr == nil {
+		return e.metrics, nil
+	}
+	if e.lastUpdated.IsZero() || (f.maxStaleness > 0 && f.now().Sub(e.lastUpdated) > f.maxStaleness) {
+		return nil, e.lastErr
+	}
+	return e.metrics, &StaleError{
+		Err:         e.lastErr,
+		LastUpdated: e.lastUpdated,
+	}
+}
+
+// Run refreshes the cached metrics of all endpoints every refreshInterval until ctx is canceled.
+// While it runs, FetchMetricsFor does not block on the upstream exporters.
+func (f *KubernetesEndpointFetcher) Run(ctx context.Context) {
+	f.mutex.Lock()
+	f.background = true
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.background = false
+		f.mutex.Unlock()
+	}()
+
+	refreshLoop(ctx, f.refreshInterval, f.refresh)
+}
+
+// refresh discovers the endpoints and refreshes their metrics concurrently.
+// Failing endpoints are logged, but don't prevent the others from being refreshed.
+func (f *KubernetesEndpointFetcher) refresh(ctx context.Context) error {
+	entries, err := f.discoverEntries(ctx)
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	for ip, e := range entries {
+		ip, e := ip, e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f.refreshEndpoint(ctx, e); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to refresh metrics of %s: %s", ip, err.Error())
 			}
-			m.Lock()
-			f.cache[ip] = metrics
-			m.Unlock()
-			return nil
-		})
+		}()
 	}
-	if err := g.Wait(); err != nil {
-		return nil, err
+	wg.Wait()
+	return nil
+}
+
+func (f *KubernetesEndpointFetcher) retry(endpoint string, e *endpointCache) {
+	ctx, cancel := context.WithTimeout(context.Background(), staleRetryTimeout)
+	defer cancel()
+	if err := f.refreshEndpoint(ctx, e); err != nil {
+		log.Printf("Failed to refresh stale metrics of %s: %s", endpoint, err.Error())
 	}
 
-	f.lastUpdated = f.now()
-	return f.cache[endpoint], nil
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.retrying = false
+}
+
+func (f *KubernetesEndpointFetcher) refreshEndpoint(ctx context.Context, e *endpointCache) error {
+	metrics, err := fetchMetrics(ctx, f.client, e.addr, f.auth)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err != nil {
+		e.lastErr = err
+		return err
+	}
+	e.metrics = metrics
+	e.lastUpdated = f.now()
+	e.lastErr = nil
+	return nil
 }
 
 func (f *KubernetesEndpointFetcher) FetchTargetConfigs(ctx context.Context, baseTarget string, basePath string) ([]StaticConfig, error) {
 	staticConfig := []StaticConfig{}
 
-	endpoints, err := f.discover(ctx)
+	targets, err := f.discover(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, ip := range endpoints {
+	for _, t := range targets {
 		conf := StaticConfig{
 			Targets: []string{baseTarget},
 			Labels: map[model.LabelName]model.LabelValue{
-				"__metrics_path__": model.LabelValue(fmt.Sprintf("%s/%s", basePath, ip)),
+				"__metrics_path__": model.LabelValue(fmt.Sprintf("%s/%s", basePath, t.id)),
 				"metrics_path":     model.LabelValue(basePath),
-				"instance":         model.LabelValue(ip),
+				"instance":         model.LabelValue(t.ip),
 			},
 		}
+		for k, v := range t.labels {
+			conf.Labels[k] = v
+		}
 		staticConfig = append(staticConfig, conf)
 	}
 	return staticConfig, nil
@@ -153,11 +466,28 @@ func (f *KubernetesEndpointFetcher) now() time.Time {
 	return time.Now()
 }
 
-func (f *KubernetesEndpointFetcher) buildAddr(ip string) string {
-	return fmt.Sprintf("%s://%s:%d%s", f.scheme, ip, f.port, f.path)
+func (f *KubernetesEndpointFetcher) buildAddr(t discoveredTarget) string {
+	return fmt.Sprintf("%s://%s%s", f.scheme, net.JoinHostPort(t.ip, strconv.Itoa(t.port)), f.path)
+}
+
+// discover returns the discovered targets, including the meta labels of their pods if podMetadata is set.
+func (f *KubernetesEndpointFetcher) discover(ctx context.Context) ([]discoveredTarget, error) {
+	targets, err := f.discoverTargets(ctx)
+	if err != nil || !f.podMetadata {
+		return targets, err
+	}
+	return f.addPodMetadata(ctx, targets)
 }
 
-func (f *KubernetesEndpointFetcher) discover(ctx context.Context) ([]string, error) {
+func (f *KubernetesEndpointFetcher) discoverTargets(ctx context.Context) ([]discoveredTarget, error) {
+	switch {
+	case f.discovery == DiscoveryPods:
+		return f.discoverPods(ctx)
+	case f.serviceSelector != nil:
+		return f.discoverServices(ctx)
+	case f.discovery == DiscoveryEndpointSlices:
+		return f.discoverEndpointSlices(ctx)
+	}
 
 	ep := corev1.Endpoints{}
 	err := f.kube.Get(ctx, types.NamespacedName{
@@ -167,30 +497,138 @@ func (f *KubernetesEndpointFetcher) discover(ctx context.Context) ([]string, err
 	if err != nil {
 		return nil, err
 	}
+	return endpointsTargets(ep, f.port), nil
+}
 
-	epIPs := []string{}
+// endpointsTargets returns the ready addresses of the Endpoints object that expose the port.
+func endpointsTargets(ep corev1.Endpoints, port string) []discoveredTarget {
+	targets := []discoveredTarget{}
 	seenIps := map[string]bool{}
 	for _, subset := range ep.Subsets {
-		if !hasPort(subset, f.port) {
+		p, ok := subsetPort(subset, port)
+		if !ok {
 			continue
 		}
 		for _, addr := range subset.Addresses {
 			if seenIps[addr.IP] {
 				continue
 			}
-			epIPs = append(epIPs, addr.IP)
+			targets = append(targets, discoveredTarget{
+				id:     addr.IP,
+				ip:     addr.IP,
+				port:   int(p.Port),
+				labels: endpointsMetaLabels(ep, addr, p),
+				pod:    podRef(ep.Namespace, addr.TargetRef),
+			})
 			seenIps[addr.IP] = true
 		}
 	}
+	return targets
+}
 
-	return epIPs, nil
+// subsetPort returns the port of the subset with the given name or number.
+func subsetPort(subset corev1.EndpointSubset, port string) (corev1.EndpointPort, bool) {
+	for _, p := range subset.Ports {
+		if portMatches(port, p.Name, p.Port) {
+			return p, true
+		}
+	}
+	return corev1.EndpointPort{}, false
 }
 
-func hasPort(subset corev1.EndpointSubset, p int) bool {
-	for _, port := range subset.Ports {
-		if int(port.Port) == p {
-			return true
+// discoverEndpointSlices returns the addresses of the ready endpoints in the EndpointSlices of the service.
+func (f *KubernetesEndpointFetcher) discoverEndpointSlices(ctx context.Context) ([]discoveredTarget, error) {
+	list := discoveryv1.EndpointSliceList{}
+	err := f.kube.List(ctx, &list,
+		client.InNamespace(f.namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: f.endpointname},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sliceTargets(list.Items, f.port), nil
+}
+
+// sliceTargets returns the addresses of the ready endpoints in the EndpointSlices of a service that expose the port.
+// Pods with both an IPv4 and an IPv6 address are only returned once, using their IPv4 address.
+func sliceTargets(slices []discoveryv1.EndpointSlice, port string) []discoveredTarget {
+	sort.SliceStable(slices, func(i, j int) bool {
+		return slices[i].AddressType == discoveryv1.AddressTypeIPv4 && slices[j].AddressType != discoveryv1.AddressTypeIPv4
+	})
+
+	targets := []discoveredTarget{}
+	seenIps := map[string]bool{}
+	seenPods := map[types.UID]bool{}
+	for _, slice := range slices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		p, ok := slicePort(slice, port)
+		if !ok {
+			continue
 		}
+		for _, ep := range slice.Endpoints {
+			if !endpointReady(ep.Conditions) || len(ep.Addresses) == 0 {
+				continue
+			}
+			if ep.TargetRef != nil && ep.TargetRef.UID != "" {
+				if seenPods[ep.TargetRef.UID] {
+					continue
+				}
+				seenPods[ep.TargetRef.UID] = true
+			}
+			// All addresses of an endpoint are fungible, so we only need the first one
+			ip := ep.Addresses[0]
+			if seenIps[ip] {
+				continue
+			}
+			targets = append(targets, discoveredTarget{
+				id:     ip,
+				ip:     ip,
+				port:   int(*p.Port),
+				labels: sliceMetaLabels(slice, ep, p),
+				pod:    podRef(slice.Namespace, ep.TargetRef),
+			})
+			seenIps[ip] = true
+		}
+	}
+	return targets
+}
+
+// endpointReady returns whether the endpoint is ready and not terminating.
+// If the readiness is unknown, the endpoint is considered ready unless it's known to not be serving.
+func endpointReady(c discoveryv1.EndpointConditions) bool {
+	if c.Terminating != nil && *c.Terminating {
+		return false
+	}
+	if c.Ready != nil {
+		return *c.Ready
+	}
+	return c.Serving == nil || *c.Serving
+}
+
+// slicePort returns the port of the EndpointSlice with the given name or number.
+// The number of the returned port is always set.
+func slicePort(slice discoveryv1.EndpointSlice, port string) (discoveryv1.EndpointPort, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if portMatches(port, name, *p.Port) {
+			return p, true
+		}
+	}
+	return discoveryv1.EndpointPort{}, false
+}
+
+// portMatches returns whether port, which is either a port name or number, refers to the port with the given name and number.
+func portMatches(port string, name string, number int32) bool {
+	if n, err := strconv.Atoi(port); err == nil {
+		return n == int(number)
 	}
-	return false
+	return port == name
 }
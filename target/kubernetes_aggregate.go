@@ -0,0 +1,160 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	instanceLabel = "instance"
+	// exportedLabelPrefix is prepended to labels of the exporter that clash with the labels added when aggregating.
+	exportedLabelPrefix = "exported_"
+)
+
+// aggregatedEndpoint holds the metrics of a single endpoint while they are aggregated.
+type aggregatedEndpoint struct {
+	labels  []*dto.LabelPair
+	metrics []dto.MetricFamily
+	err     error
+}
+
+// FetchMetrics returns the metrics of all discovered endpoints, merged into a single response.
+// Every series gets an `instance` label with the IP of its endpoint, so that the series of the different endpoints stay
+// distinct. If aggregatePodLabel is set, the name of the pod is added as this label, if known.
+// Labels of the exporter with the same name are renamed to `exported_<name>`.
+//
+// Endpoints that can't be reached are logged and left out, unless none of the endpoints can be reached.
+// If the metrics of some endpoints are stale, they are returned together with the *StaleError of the oldest of them.
+func (f *KubernetesEndpointFetcher) FetchMetrics(ctx context.Context) ([]dto.MetricFamily, error) {
+	background, entries, err := f.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	endpoints := make([]aggregatedEndpoint, len(ids))
+	wg := sync.WaitGroup{}
+	for i, id := range ids {
+		i, id := i, id
+		e := entries[id]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			labels := []*dto.LabelPair{{Name: proto.String(instanceLabel), Value: proto.String(e.instance)}}
+			if f.aggregatePodLabel != "" && e.pod != "" {
+				labels = append(labels, &dto.LabelPair{Name: proto.String(f.aggregatePodLabel), Value: proto.String(e.pod)})
+			}
+			metrics, err := f.fetchEntry(ctx, id, background, e)
+			endpoints[i] = aggregatedEndpoint{labels: labels, metrics: metrics, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var stale *StaleError
+	var lastErr error
+	reached := 0
+	for i, ep := range endpoints {
+		var s *StaleError
+		if errors.As(ep.err, &s) {
+			if stale == nil || s.LastUpdated.Before(stale.LastUpdated) {
+				stale = s
+			}
+		} else if ep.err != nil {
+			log.Printf("Failed to fetch metrics of %s: %s", ids[i], ep.err.Error())
+			lastErr = ep.err
+			continue
+		}
+		reached++
+	}
+	if reached == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	metrics := aggregateMetrics(endpoints)
+	if stale != nil {
+		return metrics, stale
+	}
+	return metrics, nil
+}
+
+// entries returns the cache entries of all endpoints.
+// While Run is running, the entries it discovered are used. Otherwise the endpoints are discovered first.
+func (f *KubernetesEndpointFetcher) entries(ctx context.Context) (bool, map[string]*endpointCache, error) {
+	f.mutex.Lock()
+	background := f.background
+	entries := f.cache
+	f.mutex.Unlock()
+	// discoverEntries replaces the map instead of modifying it, so it's safe to use without holding the lock
+	if background && len(entries) > 0 {
+		return background, entries, nil
+	}
+
+	entries, err := f.discoverEntries(ctx)
+	return background, entries, err
+}
+
+// aggregateMetrics merges the metric families of the endpoints and adds the labels of the endpoint to each series.
+// The cached metrics are not modified. Families whose type differs from the one of the first endpoint are left out.
+func aggregateMetrics(endpoints []aggregatedEndpoint) []dto.MetricFamily {
+	families := map[string]*dto.MetricFamily{}
+	names := []string{}
+	for _, ep := range endpoints {
+		for _, mf := range ep.metrics {
+			agg, ok := families[mf.GetName()]
+			if !ok {
+				agg = &dto.MetricFamily{
+					Name: mf.Name,
+					Help: mf.Help,
+					Type: mf.Type,
+				}
+				families[mf.GetName()] = agg
+				names = append(names, mf.GetName())
+			} else if agg.GetType() != mf.GetType() {
+				log.Printf("Dropping metric %s of type %s, as other endpoints expose it as %s", mf.GetName(), mf.GetType(), agg.GetType())
+				continue
+			}
+			for _, m := range mf.Metric {
+				labeled := *m
+				labeled.Label = withLabels(m.Label, ep.labels)
+				agg.Metric = append(agg.Metric, &labeled)
+			}
+		}
+	}
+
+	res := make([]dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		res = append(res, *families[name])
+	}
+	return res
+}
+
+// withLabels returns the labels with the added labels, sorted by name.
+// Labels that are also added are renamed to `exported_<name>`.
+func withLabels(labels []*dto.LabelPair, added []*dto.LabelPair) []*dto.LabelPair {
+	res := make([]*dto.LabelPair, 0, len(labels)+len(added))
+	for _, l := range labels {
+		for _, a := range added {
+			if l.GetName() == a.GetName() {
+				l = &dto.LabelPair{Name: proto.String(exportedLabelPrefix + l.GetName()), Value: l.Value}
+				break
+			}
+		}
+		res = append(res, l)
+	}
+	res = append(res, added...)
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].GetName() < res[j].GetName()
+	})
+	return res
+}
@@ -0,0 +1,148 @@
+package target
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestKube_FetchAggregated(t *testing.T) {
+	sa := startTestTarget(t, "../testdata/simple", "127.0.20.1:8911")
+	defer sa.Close()
+	sb := startTestTarget(t, "../testdata/simpletwo", "127.0.20.2:8911")
+	defer sb.Close()
+
+	// Nothing listens on 127.0.20.3
+	ep := newTestEndpoint(8911, "127.0.20.1", "127.0.20.2", "127.0.20.3")
+	ep.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: "exporter-a"}
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       sa.Client(),
+		kube:         newTestKubeEnv(ep),
+
+		aggregatePodLabel: "scraped_pod",
+	}
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	for _, mf := range metrics {
+		assert.Len(t, mf.Metric, 6, mf.GetName())
+	}
+
+	instances := map[string]int{}
+	for _, m := range metrics[0].Metric {
+		labels := labelMap(m)
+		instances[labels["instance"]]++
+		if labels["instance"] == "127.0.20.1" {
+			assert.Equal(t, "exporter-a", labels["scraped_pod"])
+		} else {
+			assert.NotContains(t, labels, "scraped_pod")
+		}
+	}
+	assert.Equal(t, map[string]int{"127.0.20.1": 3, "127.0.20.2": 3}, instances)
+
+	// The cached metrics of the endpoints are not modified
+	cached, err := f.FetchMetricsFor(context.TODO(), "127.0.20.1")
+	require.NoError(t, err)
+	for _, mf := range cached {
+		for _, m := range mf.Metric {
+			assert.NotContains(t, labelMap(m), "instance")
+		}
+	}
+}
+
+func TestKube_FetchAggregatedUpstreamPod(t *testing.T) {
+	s := startTestTarget(t, "../testdata/ksm", "127.0.20.4:8911")
+	defer s.Close()
+
+	ep := newTestEndpoint(8911, "127.0.20.4")
+	ep.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: "kube-state-metrics"}
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       s.Client(),
+		kube:         newTestKubeEnv(ep),
+	}
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	require.Len(t, metrics[0].Metric, 2)
+	for i, pod := range []string{"app-1", "app-2"} {
+		assert.Equal(t, map[string]string{
+			"instance":  "127.0.20.4",
+			"namespace": "app",
+			"pod":       pod,
+		}, labelMap(metrics[0].Metric[i]), "the pod label of the exporter must not be renamed by default")
+	}
+
+	f.aggregatePodLabel = "pod"
+	metrics, err = f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, map[string]string{
+		"instance":     "127.0.20.4",
+		"namespace":    "app",
+		"pod":          "kube-state-metrics",
+		"exported_pod": "app-1",
+	}, labelMap(metrics[0].Metric[0]))
+}
+
+func TestKube_FetchAggregatedFailure(t *testing.T) {
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       newKubernetesHTTPClient(false, nil),
+		kube: newTestKubeEnv(
+			// Nothing listens on 127.0.20.3
+			newTestEndpoint(8911, "127.0.20.3"),
+		),
+	}
+
+	_, err := f.FetchMetrics(context.TODO())
+	require.Error(t, err)
+}
+
+func TestWithLabels(t *testing.T) {
+	labels := withLabels(
+		[]*dto.LabelPair{
+			{Name: proto.String("pod"), Value: proto.String("exporter")},
+			{Name: proto.String("foo"), Value: proto.String("bar")},
+		},
+		[]*dto.LabelPair{
+			{Name: proto.String("instance"), Value: proto.String("127.0.20.1")},
+			{Name: proto.String("pod"), Value: proto.String("exporter-a")},
+		},
+	)
+	names := []string{}
+	for _, l := range labels {
+		names = append(names, l.GetName())
+	}
+	assert.Equal(t, []string{"exported_pod", "foo", "instance", "pod"}, names)
+	assert.Equal(t, "exporter", labels[0].GetValue())
+	assert.Equal(t, "exporter-a", labels[3].GetValue())
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	return labels
+}
@@ -0,0 +1,203 @@
+package target
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// metaLabelPrefix is the prefix of the meta labels that are added to the targets in the service discovery response.
+// The labels are named like the ones of the kubernetes_sd_configs of Prometheus, so that the same relabel configs can be used.
+const metaLabelPrefix = model.MetaLabelPrefix + "kubernetes_"
+
+var invalidLabelCharRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// endpointsMetaLabels returns the meta labels of an address of an Endpoints object.
+// Only ready addresses are discovered, so the address is always ready.
+func endpointsMetaLabels(ep corev1.Endpoints, addr corev1.EndpointAddress, port corev1.EndpointPort) model.LabelSet {
+	ls := model.LabelSet{
+		metaLabelPrefix + "namespace":              model.LabelValue(ep.Namespace),
+		metaLabelPrefix + "service_name":           model.LabelValue(ep.Name),
+		metaLabelPrefix + "endpoints_name":         model.LabelValue(ep.Name),
+		metaLabelPrefix + "endpoint_ready":         "true",
+		metaLabelPrefix + "endpoint_port_name":     model.LabelValue(port.Name),
+		metaLabelPrefix + "endpoint_port_protocol": model.LabelValue(port.Protocol),
+	}
+	addObjectMetaLabels(ls, "endpoints", ep.ObjectMeta)
+	if addr.Hostname != "" {
+		ls[metaLabelPrefix+"endpoint_hostname"] = model.LabelValue(addr.Hostname)
+	}
+	if addr.NodeName != nil {
+		ls[metaLabelPrefix+"endpoint_node_name"] = model.LabelValue(*addr.NodeName)
+	}
+	addTargetRefLabels(ls, "endpoint", addr.TargetRef)
+	return ls
+}
+
+// sliceMetaLabels returns the meta labels of an endpoint of an EndpointSlice.
+func sliceMetaLabels(slice discoveryv1.EndpointSlice, ep discoveryv1.Endpoint, port discoveryv1.EndpointPort) model.LabelSet {
+	ls := model.LabelSet{
+		metaLabelPrefix + "namespace":                  model.LabelValue(slice.Namespace),
+		metaLabelPrefix + "endpointslice_name":         model.LabelValue(slice.Name),
+		metaLabelPrefix + "endpointslice_address_type": model.LabelValue(slice.AddressType),
+	}
+	addObjectMetaLabels(ls, "endpointslice", slice.ObjectMeta)
+	if svc := slice.Labels[discoveryv1.LabelServiceName]; svc != "" {
+		ls[metaLabelPrefix+"service_name"] = model.LabelValue(svc)
+	}
+
+	if port.Port != nil {
+		ls[metaLabelPrefix+"endpointslice_port"] = model.LabelValue(strconv.Itoa(int(*port.Port)))
+	}
+	if port.Name != nil {
+		ls[metaLabelPrefix+"endpointslice_port_name"] = model.LabelValue(*port.Name)
+	}
+	if port.Protocol != nil {
+		ls[metaLabelPrefix+"endpointslice_port_protocol"] = model.LabelValue(*port.Protocol)
+	}
+
+	conditions := map[model.LabelName]*bool{
+		metaLabelPrefix + "endpointslice_endpoint_conditions_ready":       ep.Conditions.Ready,
+		metaLabelPrefix + "endpointslice_endpoint_conditions_serving":     ep.Conditions.Serving,
+		metaLabelPrefix + "endpointslice_endpoint_conditions_terminating": ep.Conditions.Terminating,
+	}
+	for name, c := range conditions {
+		if c != nil {
+			ls[name] = model.LabelValue(strconv.FormatBool(*c))
+		}
+	}
+	if ep.Hostname != nil {
+		ls[metaLabelPrefix+"endpointslice_endpoint_hostname"] = model.LabelValue(*ep.Hostname)
+	}
+	if ep.NodeName != nil {
+		ls[metaLabelPrefix+"endpointslice_endpoint_node_name"] = model.LabelValue(*ep.NodeName)
+	}
+	if ep.Zone != nil {
+		ls[metaLabelPrefix+"endpointslice_endpoint_zone"] = model.LabelValue(*ep.Zone)
+	}
+	addTargetRefLabels(ls, "endpointslice", ep.TargetRef)
+	return ls
+}
+
+// addTargetRefLabels adds the kind and name of the object backing an endpoint.
+// If it's a pod, its name is added as well.
+func addTargetRefLabels(ls model.LabelSet, role string, ref *corev1.ObjectReference) {
+	if ref == nil {
+		return
+	}
+	ls[model.LabelName(metaLabelPrefix+role+"_address_target_kind")] = model.LabelValue(ref.Kind)
+	ls[model.LabelName(metaLabelPrefix+role+"_address_target_name")] = model.LabelValue(ref.Name)
+	if ref.Kind == "Pod" {
+		ls[metaLabelPrefix+"pod_name"] = model.LabelValue(ref.Name)
+	}
+}
+
+// podRef returns the pod backing an endpoint, or nil if it isn't backed by a pod.
+func podRef(namespace string, ref *corev1.ObjectReference) *types.NamespacedName {
+	if ref == nil || ref.Kind != "Pod" {
+		return nil
+	}
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	return &types.NamespacedName{Namespace: namespace, Name: ref.Name}
+}
+
+// podMetaLabels returns the meta labels of a pod, including its labels and annotations.
+func podMetaLabels(pod corev1.Pod) model.LabelSet {
+	ls := model.LabelSet{
+		metaLabelPrefix + "namespace":     model.LabelValue(pod.Namespace),
+		metaLabelPrefix + "pod_name":      model.LabelValue(pod.Name),
+		metaLabelPrefix + "pod_ip":        model.LabelValue(pod.Status.PodIP),
+		metaLabelPrefix + "pod_ready":     model.LabelValue(podReady(pod)),
+		metaLabelPrefix + "pod_phase":     model.LabelValue(pod.Status.Phase),
+		metaLabelPrefix + "pod_node_name": model.LabelValue(pod.Spec.NodeName),
+		metaLabelPrefix + "pod_host_ip":   model.LabelValue(pod.Status.HostIP),
+		metaLabelPrefix + "pod_uid":       model.LabelValue(pod.UID),
+	}
+	addObjectMetaLabels(ls, "pod", pod.ObjectMeta)
+	if ref := metav1.GetControllerOf(&pod); ref != nil {
+		ls[metaLabelPrefix+"pod_controller_kind"] = model.LabelValue(ref.Kind)
+		ls[metaLabelPrefix+"pod_controller_name"] = model.LabelValue(ref.Name)
+	}
+	return ls
+}
+
+// podContainerMetaLabels returns the meta labels of the container port of the pod with the given number.
+// Numeric ports don't need to be declared by a container, in which case no labels are returned.
+func podContainerMetaLabels(pod corev1.Pod, port int) model.LabelSet {
+	ls := model.LabelSet{}
+	for _, c := range pod.Spec.Containers {
+		for _, cp := range c.Ports {
+			if int(cp.ContainerPort) != port {
+				continue
+			}
+			ls[metaLabelPrefix+"pod_container_name"] = model.LabelValue(c.Name)
+			ls[metaLabelPrefix+"pod_container_image"] = model.LabelValue(c.Image)
+			ls[metaLabelPrefix+"pod_container_port_name"] = model.LabelValue(cp.Name)
+			ls[metaLabelPrefix+"pod_container_port_number"] = model.LabelValue(strconv.Itoa(port))
+			ls[metaLabelPrefix+"pod_container_port_protocol"] = model.LabelValue(cp.Protocol)
+			return ls
+		}
+	}
+	return ls
+}
+
+// podReady returns the status of the Ready condition of the pod in lower case, or `unknown` if it isn't set.
+func podReady(pod corev1.Pod) string {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return strings.ToLower(string(c.Status))
+		}
+	}
+	return strings.ToLower(string(corev1.ConditionUnknown))
+}
+
+// addObjectMetaLabels adds the labels and annotations of an object.
+// Their names are sanitized, so a `<role>_labelpresent_<name>` label is added as well to tell apart empty and missing labels.
+func addObjectMetaLabels(ls model.LabelSet, role string, meta metav1.ObjectMeta) {
+	add := func(kind string, values map[string]string) {
+		for k, v := range values {
+			name := sanitizeLabelName(k)
+			ls[model.LabelName(metaLabelPrefix+role+"_"+kind+"_"+name)] = model.LabelValue(v)
+			ls[model.LabelName(metaLabelPrefix+role+"_"+kind+"present_"+name)] = "true"
+		}
+	}
+	add("label", meta.Labels)
+	add("annotation", meta.Annotations)
+}
+
+// sanitizeLabelName replaces all characters that aren't allowed in a label name with an underscore.
+func sanitizeLabelName(name string) string {
+	return invalidLabelCharRE.ReplaceAllString(name, "_")
+}
+
+// addPodMetadata adds the meta labels of the pods backing the targets.
+// Targets whose pod isn't known (yet) are returned without them.
+func (f *KubernetesEndpointFetcher) addPodMetadata(ctx context.Context, targets []discoveredTarget) ([]discoveredTarget, error) {
+	for _, t := range targets {
+		if t.pod == nil {
+			continue
+		}
+		pod := corev1.Pod{}
+		err := f.kube.Get(ctx, *t.pod, &pod)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range podMetaLabels(pod) {
+			t.labels[k] = v
+		}
+	}
+	return targets, nil
+}
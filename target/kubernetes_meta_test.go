@@ -0,0 +1,172 @@
+package target
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestKube_EndpointsMetaLabels(t *testing.T) {
+	ep := newTestEndpoint(8119, "127.0.19.1", "127.0.19.2")
+	ep.Labels = map[string]string{"app.kubernetes.io/name": "exporter"}
+	ep.Subsets[0].Ports[0].Protocol = corev1.ProtocolTCP
+	ep.Subsets[0].Addresses[0].NodeName = deref("node-a")
+	ep.Subsets[0].Addresses[0].TargetRef = &corev1.ObjectReference{Kind: "Pod", Name: "exporter-a"}
+
+	pod := newTestPod("exporter-a", "fetch-test", "127.0.19.1", corev1.PodRunning, map[string]string{"app.kubernetes.io/name": "exporter"})
+	pod.Annotations = map[string]string{"example.com/team": "a"}
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+
+	tcs := map[string]struct {
+		podMetadata bool
+
+		expected model.LabelSet
+		missing  []model.LabelName
+	}{
+		"withoutPodMetadata": {
+			expected: model.LabelSet{
+				"__meta_kubernetes_namespace":                                     "fetch-test",
+				"__meta_kubernetes_service_name":                                  "test-ep",
+				"__meta_kubernetes_endpoints_name":                                "test-ep",
+				"__meta_kubernetes_endpoints_label_app_kubernetes_io_name":        "exporter",
+				"__meta_kubernetes_endpoints_labelpresent_app_kubernetes_io_name": "true",
+				"__meta_kubernetes_endpoint_ready":                                "true",
+				"__meta_kubernetes_endpoint_node_name":                            "node-a",
+				"__meta_kubernetes_endpoint_port_name":                            "metrics",
+				"__meta_kubernetes_endpoint_port_protocol":                        "TCP",
+				"__meta_kubernetes_endpoint_address_target_kind":                  "Pod",
+				"__meta_kubernetes_endpoint_address_target_name":                  "exporter-a",
+				"__meta_kubernetes_pod_name":                                      "exporter-a",
+			},
+			missing: []model.LabelName{"__meta_kubernetes_pod_label_app_kubernetes_io_name"},
+		},
+		"withPodMetadata": {
+			podMetadata: true,
+			expected: model.LabelSet{
+				"__meta_kubernetes_pod_name":                                "exporter-a",
+				"__meta_kubernetes_pod_node_name":                           "node-a",
+				"__meta_kubernetes_pod_ready":                               "true",
+				"__meta_kubernetes_pod_phase":                               "Running",
+				"__meta_kubernetes_pod_label_app_kubernetes_io_name":        "exporter",
+				"__meta_kubernetes_pod_labelpresent_app_kubernetes_io_name": "true",
+				"__meta_kubernetes_pod_annotation_example_com_team":         "a",
+				"__meta_kubernetes_pod_annotationpresent_example_com_team":  "true",
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			f := KubernetesEndpointFetcher{
+				endpointname: "test-ep",
+				namespace:    "fetch-test",
+				port:         "metrics",
+				podMetadata:  tc.podMetadata,
+				kube:         newTestKubeEnv(ep, pod),
+			}
+
+			targets, err := f.discover(context.TODO())
+			require.NoError(t, err)
+			require.Len(t, targets, 2)
+			for _, target := range targets {
+				if target.ip != "127.0.19.1" {
+					// Addresses without a pod only get the labels of the endpoint
+					assert.NotContains(t, target.labels, model.LabelName("__meta_kubernetes_pod_name"))
+					continue
+				}
+				for k, v := range tc.expected {
+					assert.Equal(t, v, target.labels[k], k)
+				}
+				for _, k := range tc.missing {
+					assert.NotContains(t, target.labels, k)
+				}
+			}
+		})
+	}
+}
+
+func TestKube_EndpointSliceMetaLabels(t *testing.T) {
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "metrics",
+		discovery:    DiscoveryEndpointSlices,
+		kube: newTestKubeEnv(
+			newTestEndpointSlice("test-ep-a", "test-ep", discoveryv1.AddressTypeIPv4, 8119,
+				discoveryv1.Endpoint{
+					Addresses:  []string{"127.0.19.1"},
+					Conditions: discoveryv1.EndpointConditions{Ready: deref(true), Serving: deref(true)},
+					NodeName:   deref("node-a"),
+					Zone:       deref("zone-a"),
+					TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: "exporter-a"},
+				},
+			),
+		),
+	}
+
+	targets, err := f.discover(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	expected := model.LabelSet{
+		"__meta_kubernetes_namespace":                                 "fetch-test",
+		"__meta_kubernetes_service_name":                              "test-ep",
+		"__meta_kubernetes_endpointslice_name":                        "test-ep-a",
+		"__meta_kubernetes_endpointslice_address_type":                "IPv4",
+		"__meta_kubernetes_endpointslice_port":                        "8119",
+		"__meta_kubernetes_endpointslice_port_name":                   "metrics",
+		"__meta_kubernetes_endpointslice_endpoint_conditions_ready":   "true",
+		"__meta_kubernetes_endpointslice_endpoint_conditions_serving": "true",
+		"__meta_kubernetes_endpointslice_endpoint_node_name":          "node-a",
+		"__meta_kubernetes_endpointslice_endpoint_zone":               "zone-a",
+		"__meta_kubernetes_endpointslice_address_target_kind":         "Pod",
+		"__meta_kubernetes_endpointslice_address_target_name":         "exporter-a",
+		"__meta_kubernetes_pod_name":                                  "exporter-a",
+	}
+	for k, v := range expected {
+		assert.Equal(t, v, targets[0].labels[k], k)
+	}
+	assert.NotContains(t, targets[0].labels, model.LabelName("__meta_kubernetes_endpointslice_endpoint_conditions_terminating"))
+}
+
+func TestKube_PodMetaLabels(t *testing.T) {
+	pod := newTestPod("exporter-a", "ns-a", "127.0.19.1", corev1.PodRunning, map[string]string{"app": "exporter"})
+	pod.Spec.Containers[0].Ports[0].Protocol = corev1.ProtocolTCP
+	f := KubernetesEndpointFetcher{
+		discovery:   DiscoveryPods,
+		podSelector: labels.SelectorFromSet(labels.Set{"app": "exporter"}),
+		podPort:     "metrics",
+		kube:        newTestKubeEnv(pod),
+	}
+
+	targets, err := f.discover(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	expected := model.LabelSet{
+		"__meta_kubernetes_namespace":                   "ns-a",
+		"__meta_kubernetes_pod_name":                    "exporter-a",
+		"__meta_kubernetes_pod_ip":                      "127.0.19.1",
+		"__meta_kubernetes_pod_node_name":               "node-a",
+		"__meta_kubernetes_pod_ready":                   "unknown",
+		"__meta_kubernetes_pod_label_app":               "exporter",
+		"__meta_kubernetes_pod_labelpresent_app":        "true",
+		"__meta_kubernetes_pod_container_name":          "exporter",
+		"__meta_kubernetes_pod_container_port_name":     "metrics",
+		"__meta_kubernetes_pod_container_port_number":   "9100",
+		"__meta_kubernetes_pod_container_port_protocol": "TCP",
+	}
+	for k, v := range expected {
+		assert.Equal(t, v, targets[0].labels[k], k)
+	}
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	assert.Equal(t, "app_kubernetes_io_name", sanitizeLabelName("app.kubernetes.io/name"))
+	assert.Equal(t, "team", sanitizeLabelName("team"))
+	assert.Equal(t, "prometheus_io_scrape_", sanitizeLabelName("prometheus.io/scrape-"))
+}
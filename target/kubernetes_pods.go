@@ -0,0 +1,165 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type KubernetesPodFetcherOpts struct {
+	// Namespaces are the namespaces the pods are discovered in. If empty, pods are discovered in all namespaces.
+	Namespaces []string
+	// Selector is the label selector of the pods, for example `app=node-exporter`.
+	Selector string
+
+	// Port is the name or number of the container port that exposes the metrics.
+	Port   string
+	Path   string
+	Scheme string
+	// AggregatePodLabel is the label the name of the pod is added as to every series when aggregating.
+	// If empty, only the `instance` label is added.
+	AggregatePodLabel string
+
+	Auth               Authorizer
+	RefreshInterval    time.Duration
+	MaxStaleness       time.Duration
+	InsecureSkipVerify bool
+	// Transport is used for the requests to the exporters if set. InsecureSkipVerify is ignored in this case.
+	Transport http.RoundTripper
+}
+
+// NewKubernetesPodFetcher returns a fetcher for all running pods that match a label selector.
+// The pods are watched until ctx is canceled.
+func NewKubernetesPodFetcher(ctx context.Context, opts KubernetesPodFetcherOpts) (*KubernetesEndpointFetcher, error) {
+	selector, err := labels.Parse(opts.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod selector: %w", err)
+	}
+	if opts.Port == "" {
+		return nil, errors.New("no pod port set")
+	}
+
+	newCache := cache.New
+	cacheOpts := cache.Options{
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Pod{}: {
+				Label: selector,
+			},
+		},
+	}
+	switch len(opts.Namespaces) {
+	case 0:
+	case 1:
+		cacheOpts.Namespace = opts.Namespaces[0]
+	default:
+		newCache = cache.MultiNamespacedCacheBuilder(opts.Namespaces)
+	}
+	kubeCache, err := watch(ctx, newCache, cacheOpts, &corev1.Pod{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch pods %q: %w", opts.Selector, err)
+	}
+
+	return &KubernetesEndpointFetcher{
+		path:      opts.Path,
+		scheme:    opts.Scheme,
+		discovery: DiscoveryPods,
+
+		podNamespaces: opts.Namespaces,
+		podSelector:   selector,
+		podPort:       opts.Port,
+
+		aggregatePodLabel: opts.AggregatePodLabel,
+
+		client: newKubernetesHTTPClient(opts.InsecureSkipVerify, opts.Transport),
+		auth:   opts.Auth,
+
+		kube: kubeCache,
+
+		maxStaleness: opts.MaxStaleness,
+
+		refreshInterval: opts.RefreshInterval,
+		mutex:           sync.Mutex{},
+		cache:           map[string]*endpointCache{},
+	}, nil
+}
+
+// discoverPods returns the running pods that match the pod selector and expose the pod port.
+func (f *KubernetesEndpointFetcher) discoverPods(ctx context.Context) ([]discoveredTarget, error) {
+	pods := []corev1.Pod{}
+	namespaces := f.podNamespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	for _, ns := range namespaces {
+		list := corev1.PodList{}
+		err := f.kube.List(ctx, &list,
+			client.InNamespace(ns),
+			client.MatchingLabelsSelector{Selector: f.podSelector},
+		)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, list.Items...)
+	}
+
+	targets := []discoveredTarget{}
+	seenIps := map[string]bool{}
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil || pod.Status.PodIP == "" {
+			continue
+		}
+		port, ok := podPort(pod, f.podPort)
+		if !ok {
+			continue
+		}
+		// Pods using the host network share the IP of the node
+		if seenIps[pod.Status.PodIP] {
+			continue
+		}
+		ls := model.LabelSet{
+			"pod":       model.LabelValue(pod.Name),
+			"node":      model.LabelValue(pod.Spec.NodeName),
+			"namespace": model.LabelValue(pod.Namespace),
+		}
+		for k, v := range podMetaLabels(pod) {
+			ls[k] = v
+		}
+		for k, v := range podContainerMetaLabels(pod, port) {
+			ls[k] = v
+		}
+		targets = append(targets, discoveredTarget{
+			id:     pod.Status.PodIP,
+			ip:     pod.Status.PodIP,
+			port:   port,
+			labels: ls,
+		})
+		seenIps[pod.Status.PodIP] = true
+	}
+	return targets, nil
+}
+
+// podPort resolves the name or number of a container port of the pod.
+// Numeric ports don't need to be declared by a container.
+func podPort(pod corev1.Pod, port string) (int, bool) {
+	if p, err := strconv.Atoi(port); err == nil {
+		return p, true
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name == port {
+				return int(cp.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,132 @@
+package target
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestKube_DiscoverPods(t *testing.T) {
+	pods := []client.Object{
+		newTestPod("exporter-a", "ns-a", "127.0.10.1", corev1.PodRunning, map[string]string{"app": "exporter"}),
+		newTestPod("exporter-b", "ns-b", "127.0.10.2", corev1.PodRunning, map[string]string{"app": "exporter"}),
+		newTestPod("exporter-c", "ns-c", "127.0.10.3", corev1.PodRunning, map[string]string{"app": "exporter"}),
+		newTestPod("pending", "ns-a", "", corev1.PodPending, map[string]string{"app": "exporter"}),
+		newTestPod("failed", "ns-a", "127.0.10.4", corev1.PodFailed, map[string]string{"app": "exporter"}),
+		newTestPod("other", "ns-a", "127.0.10.5", corev1.PodRunning, map[string]string{"app": "other"}),
+	}
+	deleting := newTestPod("deleting", "ns-a", "127.0.10.6", corev1.PodRunning, map[string]string{"app": "exporter"})
+	deleting.DeletionTimestamp = deref(metav1.Now())
+	deleting.Finalizers = []string{"test"}
+	pods = append(pods, deleting)
+	unnamed := newTestPod("unnamed", "ns-a", "127.0.10.7", corev1.PodRunning, map[string]string{"app": "exporter"})
+	unnamed.Spec.Containers[0].Ports[0].Name = ""
+	pods = append(pods, unnamed)
+
+	tcs := map[string]struct {
+		namespaces []string
+		selector   string
+		port       string
+
+		expected []string
+	}{
+		"allNamespaces": {
+			selector: "app=exporter",
+			port:     "metrics",
+			expected: []string{"127.0.10.1", "127.0.10.2", "127.0.10.3"},
+		},
+		"namespaces": {
+			namespaces: []string{"ns-a", "ns-b"},
+			selector:   "app=exporter",
+			port:       "metrics",
+			expected:   []string{"127.0.10.1", "127.0.10.2"},
+		},
+		"numericPort": {
+			namespaces: []string{"ns-a"},
+			selector:   "app=exporter",
+			port:       "9100",
+			expected:   []string{"127.0.10.1", "127.0.10.7"},
+		},
+		"unknownPort": {
+			selector: "app=exporter",
+			port:     "http",
+			expected: []string{},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			selector, err := labels.Parse(tc.selector)
+			require.NoError(t, err)
+			f := KubernetesEndpointFetcher{
+				discovery:     DiscoveryPods,
+				podNamespaces: tc.namespaces,
+				podSelector:   selector,
+				podPort:       tc.port,
+				kube:          newTestKubeEnv(pods...),
+			}
+
+			targets, err := f.discover(context.TODO())
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tc.expected, targetIPs(targets))
+			for _, target := range targets {
+				assert.Equal(t, 9100, target.port)
+			}
+		})
+	}
+}
+
+func TestKube_PodTargetConfigs(t *testing.T) {
+	f := KubernetesEndpointFetcher{
+		discovery:   DiscoveryPods,
+		podSelector: labels.SelectorFromSet(labels.Set{"app": "exporter"}),
+		podPort:     "metrics",
+		kube: newTestKubeEnv(
+			newTestPod("exporter-a", "ns-a", "127.0.10.1", corev1.PodRunning, map[string]string{"app": "exporter"}),
+		),
+	}
+
+	tconfs, err := f.FetchTargetConfigs(context.TODO(), "proxy.example.com", "/pods")
+	require.NoError(t, err)
+	require.Len(t, tconfs, 1)
+	assert.Equal(t, []string{"proxy.example.com"}, tconfs[0].Targets)
+	assert.EqualValues(t, "/pods/127.0.10.1", tconfs[0].Labels["__metrics_path__"])
+	assert.EqualValues(t, "127.0.10.1", tconfs[0].Labels["instance"])
+	assert.EqualValues(t, "exporter-a", tconfs[0].Labels["pod"])
+	assert.EqualValues(t, "node-a", tconfs[0].Labels["node"])
+	assert.EqualValues(t, "ns-a", tconfs[0].Labels["namespace"])
+}
+
+func newTestPod(name string, namespace string, ip string, phase corev1.PodPhase, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-a",
+			Containers: []corev1.Container{
+				{
+					Name: "exporter",
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "metrics",
+							ContainerPort: 9100,
+						},
+					},
+				},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: phase,
+			PodIP: ip,
+		},
+	}
+}
@@ -0,0 +1,183 @@
+package target
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newKubernetesServicesFetcher returns a fetcher for the endpoints of all services that match the ServiceSelector.
+// The Endpoints and EndpointSlices carry the labels of their service, so they are watched using the same selector.
+func newKubernetesServicesFetcher(ctx context.Context, opts KubernetesEndpointFetcherOpts, discovery string, watched []client.Object) (*KubernetesEndpointFetcher, error) {
+	serviceSelector, err := labels.Parse(opts.ServiceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid service selector: %w", err)
+	}
+	namespaces := opts.Namespaces
+	if opts.Namespace != "" {
+		namespaces = append([]string{opts.Namespace}, namespaces...)
+	}
+	var namespaceSelector labels.Selector
+	if opts.NamespaceSelector != "" {
+		if len(namespaces) > 0 {
+			return nil, errors.New("namespaces and a namespace selector can't be set at the same time")
+		}
+		namespaceSelector, err = labels.Parse(opts.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	}
+
+	newCache := cache.New
+	cacheOpts := cache.Options{
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.Endpoints{}: {
+				Label: serviceSelector,
+			},
+			&discoveryv1.EndpointSlice{}: {
+				Label: serviceSelector,
+			},
+			&corev1.Namespace{}: {
+				Label: namespaceSelector,
+			},
+		},
+	}
+	switch len(namespaces) {
+	case 0:
+	case 1:
+		cacheOpts.Namespace = namespaces[0]
+	default:
+		newCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	objs := watched
+	if namespaceSelector != nil {
+		objs = append(objs, &corev1.Namespace{})
+	}
+	kubeCache, err := watch(ctx, newCache, cacheOpts, objs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch services %q: %w", opts.ServiceSelector, err)
+	}
+
+	return &KubernetesEndpointFetcher{
+		port:      opts.Port,
+		path:      opts.Path,
+		scheme:    opts.Scheme,
+		discovery: discovery,
+
+		namespaces:        namespaces,
+		namespaceSelector: namespaceSelector,
+		serviceSelector:   serviceSelector,
+		podMetadata:       opts.PodMetadata,
+		aggregatePodLabel: opts.AggregatePodLabel,
+
+		client: newKubernetesHTTPClient(opts.InsecureSkipVerify, opts.Transport),
+		auth:   opts.Auth,
+
+		kube: kubeCache,
+
+		maxStaleness: opts.MaxStaleness,
+
+		refreshInterval: opts.RefreshInterval,
+		mutex:           sync.Mutex{},
+		cache:           map[string]*endpointCache{},
+	}, nil
+}
+
+// discoverServices returns the endpoints of all services that match the service selector.
+// The ID of every endpoint is `<namespace>/<service>/<ip>`, as the same pod can be part of multiple services.
+func (f *KubernetesEndpointFetcher) discoverServices(ctx context.Context) ([]discoveredTarget, error) {
+	namespaces, err := f.selectedNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	services := map[types.NamespacedName][]discoveredTarget{}
+	for _, ns := range namespaces {
+		if f.discovery == DiscoveryEndpointSlices {
+			list := discoveryv1.EndpointSliceList{}
+			err := f.kube.List(ctx, &list, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: f.serviceSelector})
+			if err != nil {
+				return nil, err
+			}
+			slices := map[types.NamespacedName][]discoveryv1.EndpointSlice{}
+			for _, slice := range list.Items {
+				name := slice.Labels[discoveryv1.LabelServiceName]
+				if name == "" {
+					continue
+				}
+				svc := types.NamespacedName{Namespace: slice.Namespace, Name: name}
+				slices[svc] = append(slices[svc], slice)
+			}
+			for svc, s := range slices {
+				services[svc] = sliceTargets(s, f.port)
+			}
+			continue
+		}
+
+		list := corev1.EndpointsList{}
+		err := f.kube.List(ctx, &list, client.InNamespace(ns), client.MatchingLabelsSelector{Selector: f.serviceSelector})
+		if err != nil {
+			return nil, err
+		}
+		for _, ep := range list.Items {
+			services[types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}] = endpointsTargets(ep, f.port)
+		}
+	}
+
+	names := make([]types.NamespacedName, 0, len(services))
+	for svc := range services {
+		names = append(names, svc)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+
+	targets := []discoveredTarget{}
+	// A pod often backs multiple selected services, for example a headless and a regular one.
+	// It's only scraped through the first of them, as the series of both would be identical.
+	seen := map[string]bool{}
+	for _, svc := range names {
+		for _, t := range services[svc] {
+			addr := net.JoinHostPort(t.ip, strconv.Itoa(t.port))
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			t.id = fmt.Sprintf("%s/%s/%s", svc.Namespace, svc.Name, t.ip)
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// selectedNamespaces returns the namespaces to discover services in.
+// The empty namespace selects all namespaces.
+func (f *KubernetesEndpointFetcher) selectedNamespaces(ctx context.Context) ([]string, error) {
+	if f.namespaceSelector == nil {
+		if len(f.namespaces) == 0 {
+			return []string{""}, nil
+		}
+		return f.namespaces, nil
+	}
+
+	list := corev1.NamespaceList{}
+	if err := f.kube.List(ctx, &list, client.MatchingLabelsSelector{Selector: f.namespaceSelector}); err != nil {
+		return nil, err
+	}
+	namespaces := []string{}
+	for _, ns := range list.Items {
+		namespaces = append(namespaces, ns.Name)
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,203 @@
+package target
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestKube_DiscoverServices(t *testing.T) {
+	objs := []client.Object{
+		newTestNamespace("ns-a", map[string]string{"team": "a"}),
+		newTestNamespace("ns-b", map[string]string{"team": "a"}),
+		newTestNamespace("ns-c", map[string]string{"team": "c"}),
+		newTestServiceEndpoints("ns-a", "exporter", map[string]string{"app": "exporter"}, "127.0.11.1", "127.0.11.2"),
+		newTestServiceEndpoints("ns-a", "other", map[string]string{"app": "other"}, "127.0.11.3"),
+		newTestServiceEndpoints("ns-b", "exporter", map[string]string{"app": "exporter"}, "127.0.11.4"),
+		newTestServiceEndpoints("ns-c", "exporter", map[string]string{"app": "exporter"}, "127.0.11.5"),
+		// The pod also backs ns-c/exporter, so it's only discovered once
+		newTestServiceEndpoints("ns-c", "exporter-two", map[string]string{"app": "exporter"}, "127.0.11.5"),
+	}
+	for _, obj := range objs {
+		if ep, ok := obj.(*corev1.Endpoints); ok {
+			objs = append(objs, endpointsToSlice(ep))
+		}
+	}
+
+	tcs := map[string]struct {
+		namespaces        []string
+		namespaceSelector string
+
+		expected []string
+	}{
+		"allNamespaces": {
+			expected: []string{
+				"ns-a/exporter/127.0.11.1",
+				"ns-a/exporter/127.0.11.2",
+				"ns-b/exporter/127.0.11.4",
+				"ns-c/exporter/127.0.11.5",
+			},
+		},
+		"namespaces": {
+			namespaces: []string{"ns-b", "ns-c"},
+			expected: []string{
+				"ns-b/exporter/127.0.11.4",
+				"ns-c/exporter/127.0.11.5",
+			},
+		},
+		"namespaceSelector": {
+			namespaceSelector: "team=a",
+			expected: []string{
+				"ns-a/exporter/127.0.11.1",
+				"ns-a/exporter/127.0.11.2",
+				"ns-b/exporter/127.0.11.4",
+			},
+		},
+	}
+
+	for name, tc := range tcs {
+		for _, discovery := range []string{DiscoveryEndpoints, DiscoveryEndpointSlices} {
+			t.Run(name+"/"+discovery, func(t *testing.T) {
+				f := KubernetesEndpointFetcher{
+					port:            "metrics",
+					discovery:       discovery,
+					namespaces:      tc.namespaces,
+					serviceSelector: labels.SelectorFromSet(labels.Set{"app": "exporter"}),
+					kube:            newTestKubeEnv(objs...),
+				}
+				if tc.namespaceSelector != "" {
+					sel, err := labels.Parse(tc.namespaceSelector)
+					require.NoError(t, err)
+					f.namespaceSelector = sel
+				}
+
+				targets, err := f.discover(context.TODO())
+				require.NoError(t, err)
+				ids := []string{}
+				for _, target := range targets {
+					ids = append(ids, target.id)
+				}
+				assert.Equal(t, tc.expected, ids)
+			})
+		}
+	}
+}
+
+func TestKube_FetchServices(t *testing.T) {
+	sa := startTestTarget(t, "../testdata/simple", "127.0.8.1:8911")
+	defer sa.Close()
+
+	f := KubernetesEndpointFetcher{
+		port:            "metrics",
+		path:            "/",
+		scheme:          "http",
+		client:          sa.Client(),
+		serviceSelector: labels.SelectorFromSet(labels.Set{"app": "exporter"}),
+		kube: newTestKubeEnv(
+			newTestServiceEndpoints("ns-a", "exporter", map[string]string{"app": "exporter"}, "127.0.8.1"),
+		),
+	}
+
+	tconfs, err := f.FetchTargetConfigs(context.TODO(), "proxy.example.com", "/exporter")
+	require.NoError(t, err)
+	require.Len(t, tconfs, 1)
+	assert.EqualValues(t, "/exporter/ns-a/exporter/127.0.8.1", tconfs[0].Labels["__metrics_path__"])
+	assert.EqualValues(t, "127.0.8.1", tconfs[0].Labels["instance"])
+	assert.EqualValues(t, "ns-a", tconfs[0].Labels["__meta_kubernetes_namespace"])
+	assert.EqualValues(t, "exporter", tconfs[0].Labels["__meta_kubernetes_service_name"])
+	assert.NotContains(t, tconfs[0].Labels, model.LabelName("namespace"), "target labels must not overwrite the labels of the metrics")
+	assert.NotContains(t, tconfs[0].Labels, model.LabelName("service"), "target labels must not overwrite the labels of the metrics")
+
+	metrics, err := f.FetchMetricsFor(context.TODO(), "ns-a/exporter/127.0.8.1")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	metrics, err = f.FetchMetricsFor(context.TODO(), "127.0.8.1")
+	require.NoError(t, err)
+	assert.Nil(t, metrics)
+}
+
+func newTestNamespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+	}
+}
+
+func TestKube_FetchServicesSharedPod(t *testing.T) {
+	sa := startTestTarget(t, "../testdata/simple", "127.0.8.1:8911")
+	defer sa.Close()
+
+	f := KubernetesEndpointFetcher{
+		port:            "metrics",
+		path:            "/",
+		scheme:          "http",
+		client:          sa.Client(),
+		serviceSelector: labels.SelectorFromSet(labels.Set{"app": "exporter"}),
+		kube: newTestKubeEnv(
+			newTestServiceEndpoints("ns-a", "exporter", map[string]string{"app": "exporter"}, "127.0.8.1"),
+			newTestServiceEndpoints("ns-a", "exporter-headless", map[string]string{"app": "exporter"}, "127.0.8.1"),
+		),
+	}
+
+	tconfs, err := f.FetchTargetConfigs(context.TODO(), "proxy.example.com", "/exporter")
+	require.NoError(t, err)
+	require.Len(t, tconfs, 1, "a pod backing multiple services should only be scraped once")
+	assert.EqualValues(t, "/exporter/ns-a/exporter/127.0.8.1", tconfs[0].Labels["__metrics_path__"])
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	for _, mf := range metrics {
+		assert.Len(t, mf.Metric, 3, "the series of the pod should not be duplicated when aggregating")
+	}
+}
+
+func newTestServiceEndpoints(namespace string, name string, labels map[string]string, ips ...string) *corev1.Endpoints {
+	ep := newTestEndpoint(8911, ips...)
+	ep.Namespace = namespace
+	ep.Name = name
+	ep.Labels = labels
+	return ep
+}
+
+// endpointsToSlice returns the EndpointSlice the EndpointSlice controller would create for the Endpoints object.
+func endpointsToSlice(ep *corev1.Endpoints) *discoveryv1.EndpointSlice {
+	lbls := map[string]string{
+		discoveryv1.LabelServiceName: ep.Name,
+	}
+	for k, v := range ep.Labels {
+		lbls[k] = v
+	}
+	endpoints := []discoveryv1.Endpoint{}
+	for _, addr := range ep.Subsets[0].Addresses {
+		endpoints = append(endpoints, discoveryv1.Endpoint{
+			Addresses: []string{addr.IP},
+		})
+	}
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ep.Name + "-abcde",
+			Namespace: ep.Namespace,
+			Labels:    lbls,
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name: deref(ep.Subsets[0].Ports[0].Name),
+				Port: deref(ep.Subsets[0].Ports[0].Port),
+			},
+		},
+	}
+}
@@ -2,11 +2,15 @@ package target
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,11 +18,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -32,14 +38,13 @@ func TestKube_Fetch(t *testing.T) {
 	f := KubernetesEndpointFetcher{
 		endpointname: "test-ep",
 		namespace:    "fetch-test",
-		port:         8911,
+		port:         "8911",
 		path:         "/",
 		scheme:       "http",
 		client:       sa.Client(),
 		kube: newTestKubeEnv(
 			newTestEndpoint(8911, "127.0.8.1", "127.0.8.2"),
 		),
-		cache: map[string][]dto.MetricFamily{},
 	}
 
 	metrics, err := f.FetchMetricsFor(context.TODO(), "127.0.8.1")
@@ -97,14 +102,13 @@ func TestKube_FetchCache(t *testing.T) {
 	f := KubernetesEndpointFetcher{
 		endpointname: "test-ep",
 		namespace:    "fetch-test",
-		port:         8911,
+		port:         "8911",
 		path:         "/",
 		scheme:       "http",
 		client:       sa.Client(),
 		kube: newTestKubeEnv(
 			newTestEndpoint(8911, "127.0.8.1", "127.0.8.2"),
 		),
-		cache:           map[string][]dto.MetricFamily{},
 		refreshInterval: 5 * time.Second,
 		clock:           fakeClock,
 	}
@@ -113,7 +117,7 @@ func TestKube_FetchCache(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, metrics, 2)
 	assert.Equal(t, 1, counterA)
-	assert.Equal(t, 1, counterB)
+	assert.Equal(t, 0, counterB, "only the requested endpoint should be queried")
 	metrics, err = f.FetchMetricsFor(context.TODO(), "127.0.8.2")
 	require.NoError(t, err)
 	assert.Len(t, metrics, 2)
@@ -129,16 +133,125 @@ func TestKube_FetchCache(t *testing.T) {
 	metrics, err = f.FetchMetricsFor(context.TODO(), "127.0.8.2")
 	require.NoError(t, err)
 	assert.Len(t, metrics, 2)
-	assert.Equal(t, 2, counterA)
+	assert.Equal(t, 1, counterA)
 	assert.Equal(t, 2, counterB)
 }
 
+func TestKube_FetchPartialFailure(t *testing.T) {
+	sa := startTestTarget(t, "../testdata/simple", "127.0.8.1:8911")
+	defer sa.Close()
+
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       sa.Client(),
+		kube: newTestKubeEnv(
+			// Nothing listens on 127.0.8.3
+			newTestEndpoint(8911, "127.0.8.1", "127.0.8.3"),
+		),
+		refreshInterval: 5 * time.Second,
+	}
+
+	_, err := f.FetchMetricsFor(context.TODO(), "127.0.8.3")
+	require.Error(t, err)
+
+	metrics, err := f.FetchMetricsFor(context.TODO(), "127.0.8.1")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	require.NoError(t, f.refresh(context.TODO()))
+	metrics, err = f.FetchMetricsFor(context.TODO(), "127.0.8.1")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+}
+
+func TestKube_FetchEvict(t *testing.T) {
+	sa := startTestTarget(t, "../testdata/simple", "127.0.8.1:8911")
+	defer sa.Close()
+	sb := startTestTarget(t, "../testdata/simpletwo", "127.0.8.2:8911")
+	defer sb.Close()
+
+	kube := newTestKubeEnv(
+		newTestEndpoint(8911, "127.0.8.1", "127.0.8.2"),
+	)
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       sa.Client(),
+		kube:         kube,
+	}
+
+	metrics, err := f.FetchMetricsFor(context.TODO(), "127.0.8.2")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	assert.Contains(t, f.cache, "127.0.8.2")
+
+	ep := &corev1.Endpoints{}
+	require.NoError(t, kube.Get(context.TODO(), client.ObjectKey{Namespace: "fetch-test", Name: "test-ep"}, ep))
+	ep.Subsets = newTestEndpoint(8911, "127.0.8.1").Subsets
+	require.NoError(t, kube.Update(context.TODO(), ep))
+
+	metrics, err = f.FetchMetricsFor(context.TODO(), "127.0.8.2")
+	require.NoError(t, err)
+	assert.Nil(t, metrics, "endpoint should be gone")
+	assert.NotContains(t, f.cache, "127.0.8.2", "cache entry should be evicted")
+	assert.Contains(t, f.cache, "127.0.8.1")
+}
+
+func TestKube_FetchBackground(t *testing.T) {
+	var counterA int32
+	sa := startTestTarget(t, "../testdata/simple", "127.0.8.1:8911", func() {
+		atomic.AddInt32(&counterA, 1)
+	})
+	defer sa.Close()
+
+	f := KubernetesEndpointFetcher{
+		endpointname: "test-ep",
+		namespace:    "fetch-test",
+		port:         "8911",
+		path:         "/",
+		scheme:       "http",
+		client:       sa.Client(),
+		kube: newTestKubeEnv(
+			newTestEndpoint(8911, "127.0.8.1"),
+		),
+		refreshInterval: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&counterA) >= 2
+	}, time.Second, time.Millisecond, "metrics should be refreshed in the background")
+
+	metrics, err := f.FetchMetricsFor(context.TODO(), "127.0.8.1")
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh did not stop")
+	}
+}
+
 func TestKube_Discover(t *testing.T) {
 
 	tcs := map[string]struct {
 		name      string
 		namespace string
-		port      int
+		port      string
 
 		endpoints []client.Object
 
@@ -148,14 +261,14 @@ func TestKube_Discover(t *testing.T) {
 		"notFound": {
 			name:      "test-ep",
 			namespace: "fetch-test",
-			port:      9001,
+			port:      "9001",
 
 			errCheck: apierrors.IsNotFound,
 		},
 		"simple": {
 			name:      "test-ep",
 			namespace: "fetch-test",
-			port:      9001,
+			port:      "9001",
 			expected:  []string{"127.0.9.1", "127.0.9.2", "127.0.9.3"},
 			endpoints: []client.Object{
 				&corev1.Endpoints{
@@ -194,7 +307,7 @@ func TestKube_Discover(t *testing.T) {
 		"noMatchingPort": {
 			name:      "test-ep",
 			namespace: "fetch-test",
-			port:      9008,
+			port:      "9008",
 			expected:  []string{},
 			endpoints: []client.Object{
 				&corev1.Endpoints{
@@ -233,7 +346,7 @@ func TestKube_Discover(t *testing.T) {
 		"partialMatch": {
 			name:      "test-ep",
 			namespace: "fetch-test",
-			port:      9002,
+			port:      "9002",
 			expected:  []string{"127.0.9.1", "127.0.9.2", "127.0.9.5"},
 			endpoints: []client.Object{
 				&corev1.Endpoints{
@@ -325,14 +438,180 @@ func TestKube_Discover(t *testing.T) {
 				require.True(t, tc.errCheck(err))
 			}
 
+			ips := targetIPs(targets)
 			for _, exp := range tc.expected {
-				assert.Contains(t, targets, exp)
+				assert.Contains(t, ips, exp)
+			}
+			assert.Len(t, ips, len(tc.expected))
+		})
+	}
+}
+
+func TestKube_DiscoverNamedPort(t *testing.T) {
+	ep := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-ep",
+			Namespace: "fetch-test",
+		},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "127.0.9.1"}, {IP: "127.0.9.2"}},
+				Ports: []corev1.EndpointPort{
+					{Name: "http", Port: 8080},
+					{Name: "metrics", Port: 9001},
+				},
+			},
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "127.0.9.3"}},
+				Ports: []corev1.EndpointPort{
+					{Name: "metrics", Port: 9002},
+				},
+			},
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "127.0.9.4"}},
+				Ports: []corev1.EndpointPort{
+					{Name: "http", Port: 9001},
+				},
+			},
+		},
+	}
+	ready := discoveryv1.EndpointConditions{Ready: deref(true)}
+	sliceA := newTestEndpointSlice("test-ep-a", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+		discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready},
+		discoveryv1.Endpoint{Addresses: []string{"127.0.9.2"}, Conditions: ready},
+	)
+	sliceB := newTestEndpointSlice("test-ep-b", "test-ep", discoveryv1.AddressTypeIPv4, 9002,
+		discoveryv1.Endpoint{Addresses: []string{"127.0.9.3"}, Conditions: ready},
+	)
+	sliceC := newTestEndpointSlice("test-ep-c", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+		discoveryv1.Endpoint{Addresses: []string{"127.0.9.4"}, Conditions: ready},
+	)
+	sliceC.Ports[0].Name = deref("http")
+
+	expected := map[string]int{
+		"127.0.9.1": 9001,
+		"127.0.9.2": 9001,
+		"127.0.9.3": 9002,
+	}
+	for _, discovery := range []string{DiscoveryEndpoints, DiscoveryEndpointSlices} {
+		f := KubernetesEndpointFetcher{
+			endpointname: "test-ep",
+			namespace:    "fetch-test",
+			port:         "metrics",
+			discovery:    discovery,
+			kube:         newTestKubeEnv(ep, sliceA, sliceB, sliceC),
+		}
+
+		targets, err := f.discover(context.TODO())
+		require.NoError(t, err)
+		ports := map[string]int{}
+		for _, target := range targets {
+			ports[target.ip] = target.port
+		}
+		assert.Equal(t, expected, ports, discovery)
+	}
+}
+
+func TestKube_DiscoverEndpointSlices(t *testing.T) {
+	ready := discoveryv1.EndpointConditions{Ready: deref(true)}
+
+	tcs := map[string]struct {
+		port   string
+		slices []client.Object
+
+		expected []string
+	}{
+		"empty": {
+			port:     "9001",
+			expected: []string{},
+		},
+		"simple": {
+			port: "9001",
+			slices: []client.Object{
+				newTestEndpointSlice("test-ep-a", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.2"}, Conditions: ready},
+				),
+				newTestEndpointSlice("test-ep-b", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.3"}, Conditions: ready},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready},
+				),
+				newTestEndpointSlice("other-ep", "other-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.4"}, Conditions: ready},
+				),
+			},
+			expected: []string{"127.0.9.1", "127.0.9.2", "127.0.9.3"},
+		},
+		"noMatchingPort": {
+			port: "9008",
+			slices: []client.Object{
+				newTestEndpointSlice("test-ep-a", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready},
+				),
+			},
+			expected: []string{},
+		},
+		"conditions": {
+			port: "9001",
+			slices: []client.Object{
+				newTestEndpointSlice("test-ep-a", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.2"}},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.3"}, Conditions: discoveryv1.EndpointConditions{Ready: deref(false)}},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.4"}, Conditions: discoveryv1.EndpointConditions{Serving: deref(false)}},
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.5"}, Conditions: discoveryv1.EndpointConditions{
+						Serving:     deref(true),
+						Terminating: deref(true),
+					}},
+				),
+			},
+			expected: []string{"127.0.9.1", "127.0.9.2"},
+		},
+		"dualStack": {
+			port: "9001",
+			slices: []client.Object{
+				newTestEndpointSlice("test-ep-v6", "test-ep", discoveryv1.AddressTypeIPv6, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"fd00::1"}, Conditions: ready, TargetRef: &corev1.ObjectReference{Kind: "Pod", UID: "a"}},
+					discoveryv1.Endpoint{Addresses: []string{"fd00::2"}, Conditions: ready, TargetRef: &corev1.ObjectReference{Kind: "Pod", UID: "b"}},
+				),
+				newTestEndpointSlice("test-ep-v4", "test-ep", discoveryv1.AddressTypeIPv4, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"127.0.9.1"}, Conditions: ready, TargetRef: &corev1.ObjectReference{Kind: "Pod", UID: "a"}},
+				),
+				newTestEndpointSlice("test-ep-fqdn", "test-ep", discoveryv1.AddressTypeFQDN, 9001,
+					discoveryv1.Endpoint{Addresses: []string{"foo.example.com"}, Conditions: ready},
+				),
+			},
+			expected: []string{"127.0.9.1", "fd00::2"},
+		},
+	}
+
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			f := KubernetesEndpointFetcher{
+				endpointname: "test-ep",
+				namespace:    "fetch-test",
+				port:         tc.port,
+				discovery:    DiscoveryEndpointSlices,
+				kube:         newTestKubeEnv(tc.slices...),
 			}
-			assert.Len(t, targets, len(tc.expected))
+
+			targets, err := f.discover(context.TODO())
+			require.NoError(t, err)
+			assert.ElementsMatch(t, tc.expected, targetIPs(targets))
 		})
 	}
 }
 
+func TestKube_BuildAddr(t *testing.T) {
+	f := KubernetesEndpointFetcher{
+		port:   "9001",
+		path:   "/metrics",
+		scheme: "http",
+	}
+	assert.Equal(t, "http://127.0.9.1:9001/metrics", f.buildAddr(discoveredTarget{ip: "127.0.9.1", port: 9001}))
+	assert.Equal(t, "http://[fd00::1]:9001/metrics", f.buildAddr(discoveredTarget{ip: "fd00::1", port: 9001}))
+}
+
 func startTestTarget(t *testing.T, sourceFile string, listenOn string, callback ...func()) *httptest.Server {
 	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		data, err := os.ReadFile(sourceFile)
@@ -388,13 +667,45 @@ func newTestEndpoint(port int, ips ...string) *corev1.Endpoints {
 	}
 }
 
+func newTestEndpointSlice(name string, service string, addressType discoveryv1.AddressType, port int, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "fetch-test",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: service,
+			},
+		},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name: deref("metrics"),
+				Port: deref(int32(port)),
+			},
+		},
+	}
+}
+
+func targetIPs(targets []discoveredTarget) []string {
+	ips := []string{}
+	for _, t := range targets {
+		ips = append(ips, t.ip)
+	}
+	return ips
+}
+
+func deref[T any](x T) *T {
+	return &x
+}
+
 func TestKube_FetchTargetConfigs(t *testing.T) {
 	podIps := []string{"127.0.18.1", "127.0.18.2", "127.0.18.4", "127.0.18.8"}
 
 	f := KubernetesEndpointFetcher{
 		endpointname: "test-ep",
 		namespace:    "fetch-test",
-		port:         8119,
+		port:         "8119",
 		kube: newTestKubeEnv(
 			newTestEndpoint(8119, podIps...),
 		),
@@ -409,7 +720,9 @@ func TestKube_FetchTargetConfigs(t *testing.T) {
 	for i, tconf := range tconfs {
 		require.Len(t, tconf.Targets, 1)
 		assert.Equal(t, "proxy.example.com", tconf.Targets[0])
-		assert.Len(t, tconf.Labels, 3)
+		assert.EqualValues(t, "fetch-test", tconf.Labels["__meta_kubernetes_namespace"])
+		assert.EqualValues(t, "test-ep", tconf.Labels["__meta_kubernetes_service_name"])
+		assert.EqualValues(t, "true", tconf.Labels["__meta_kubernetes_endpoint_ready"])
 
 		inst := string(tconf.Labels["instance"])
 		assert.Contains(t, podIps, inst)
@@ -422,3 +735,188 @@ func TestKube_FetchTargetConfigs(t *testing.T) {
 		assert.EqualValues(t, "/buzz", confMap[pip].Labels["metrics_path"])
 	}
 }
+
+func TestKube_Watch(t *testing.T) {
+	api := startFakeAPIServer(t)
+	defer api.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewKubernetesEndpointFetcher(ctx, KubernetesEndpointFetcherOpts{
+		Endpointname: "test-ep",
+		Namespace:    "fetch-test",
+		Port:         "metrics",
+		Scheme:       "http",
+	})
+	require.NoError(t, err)
+	require.Eventually(t, api.watching, 10*time.Second, 10*time.Millisecond, "the endpoints should be watched")
+
+	instances := func() ([]string, error) {
+		conf, err := f.FetchTargetConfigs(ctx, "proxy.example.com", "/kube")
+		ips := []string{}
+		for _, c := range conf {
+			ips = append(ips, string(c.Labels["instance"]))
+		}
+		return ips, err
+	}
+	eventually := func(expected []string, msg string) {
+		assert.Eventually(t, func() bool {
+			ips, err := instances()
+			return err == nil && assert.ObjectsAreEqual(expected, ips)
+		}, 10*time.Second, 10*time.Millisecond, msg)
+	}
+
+	_, err = instances()
+	assert.True(t, apierrors.IsNotFound(err), "the endpoints don't exist yet")
+
+	api.send(watchAdded, newTestEndpoint(8911, "127.0.30.1"))
+	eventually([]string{"127.0.30.1"}, "added endpoints should be discovered")
+
+	api.send(watchModified, newTestEndpoint(8911, "127.0.30.1", "127.0.30.2"))
+	eventually([]string{"127.0.30.1", "127.0.30.2"}, "updated endpoints should be discovered")
+
+	api.send(watchDeleted, newTestEndpoint(8911, "127.0.30.1", "127.0.30.2"))
+	assert.Eventually(t, func() bool {
+		_, err := instances()
+		return apierrors.IsNotFound(err)
+	}, 10*time.Second, 10*time.Millisecond, "deleted endpoints should not be discovered")
+
+	for i := 0; i < 5; i++ {
+		_, err := instances()
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, api.requests(), "the service discovery should be served from the cache, only the initial list should query the API server")
+}
+
+const (
+	watchAdded    = "ADDED"
+	watchModified = "MODIFIED"
+	watchDeleted  = "DELETED"
+)
+
+// fakeAPIServer serves the Endpoints of the Kubernetes API and streams the sent events to its watchers.
+// It counts all requests for Endpoints except for watches.
+type fakeAPIServer struct {
+	*httptest.Server
+	t *testing.T
+
+	mutex           sync.Mutex
+	resourceVersion int
+	watchers        []chan metav1.WatchEvent
+	lists           int
+}
+
+// startFakeAPIServer starts a fakeAPIServer without any Endpoints, which is used by the watches until the test ends.
+func startFakeAPIServer(t *testing.T) *fakeAPIServer {
+	api := &fakeAPIServer{t: t, resourceVersion: 1}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", func(rw http.ResponseWriter, req *http.Request) {
+		api.write(rw, &metav1.APIVersions{
+			TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+			Versions: []string{"v1"},
+		})
+	})
+	mux.HandleFunc("/apis", func(rw http.ResponseWriter, req *http.Request) {
+		api.write(rw, &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+		})
+	})
+	mux.HandleFunc("/api/v1", func(rw http.ResponseWriter, req *http.Request) {
+		api.write(rw, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{{
+				Name:       "endpoints",
+				Namespaced: true,
+				Kind:       "Endpoints",
+				Verbs:      metav1.Verbs{"get", "list", "watch"},
+			}},
+		})
+	})
+	mux.HandleFunc("/api/v1/namespaces/fetch-test/endpoints", func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("watch") == "true" {
+			api.watch(rw, req)
+			return
+		}
+		api.mutex.Lock()
+		api.lists++
+		list := &corev1.EndpointsList{
+			TypeMeta: metav1.TypeMeta{Kind: "EndpointsList", APIVersion: "v1"},
+			ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(api.resourceVersion)},
+		}
+		api.mutex.Unlock()
+		api.write(rw, list)
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		api.mutex.Lock()
+		api.lists++
+		api.mutex.Unlock()
+		rw.WriteHeader(http.StatusNotFound)
+	})
+	api.Server = httptest.NewServer(mux)
+
+	original := getRESTConfig
+	getRESTConfig = func() (*rest.Config, error) {
+		return &rest.Config{Host: api.URL}, nil
+	}
+	t.Cleanup(func() {
+		getRESTConfig = original
+	})
+	return api
+}
+
+func (api *fakeAPIServer) write(rw http.ResponseWriter, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	require.NoError(api.t, json.NewEncoder(rw).Encode(obj))
+}
+
+func (api *fakeAPIServer) watch(rw http.ResponseWriter, req *http.Request) {
+	events := make(chan metav1.WatchEvent, 10)
+	api.mutex.Lock()
+	api.watchers = append(api.watchers, events)
+	api.mutex.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e := <-events:
+			if err := json.NewEncoder(rw).Encode(e); err != nil {
+				return
+			}
+			rw.(http.Flusher).Flush()
+		}
+	}
+}
+
+// watching returns whether the Endpoints are watched.
+func (api *fakeAPIServer) watching() bool {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return len(api.watchers) > 0
+}
+
+// requests returns the number of requests for Endpoints that weren't watches.
+func (api *fakeAPIServer) requests() int {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return api.lists
+}
+
+// send sends an event for the Endpoints to all watchers.
+func (api *fakeAPIServer) send(eventType string, ep *corev1.Endpoints) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	api.resourceVersion++
+	ep = ep.DeepCopy()
+	ep.TypeMeta = metav1.TypeMeta{Kind: "Endpoints", APIVersion: "v1"}
+	ep.ResourceVersion = strconv.Itoa(api.resourceVersion)
+	raw, err := json.Marshal(ep)
+	require.NoError(api.t, err)
+	for _, w := range api.watchers {
+		w <- metav1.WatchEvent{Type: eventType, Object: runtime.RawExtension{Raw: raw}}
+	}
+}
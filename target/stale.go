@@ -0,0 +1,26 @@
+package target
+
+import (
+	"fmt"
+	"time"
+)
+
+// staleRetryTimeout limits how long a background retry after a failed fetch may take.
+const staleRetryTimeout = 30 * time.Second
+
+// StaleError is returned together with the last successfully fetched metrics if refreshing them failed,
+// but they are not older than the configured maximum staleness.
+type StaleError struct {
+	// Err is the error of the failed refresh.
+	Err error
+	// LastUpdated is when the returned metrics were fetched.
+	LastUpdated time.Time
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("serving metrics fetched at %s: %s", e.LastUpdated.Format(time.RFC3339), e.Err.Error())
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
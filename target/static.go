@@ -3,6 +3,7 @@ package target
 import (
 	"context"
 	"crypto/tls"
+	"log"
 	"net/http"
 	"sync"
 	"time"
@@ -12,53 +13,136 @@ import (
 )
 
 type StaticFetcher struct {
-	URL       string
-	Client    *http.Client
-	AuthToken string
+	URL    string
+	Client *http.Client
+	// Auth provides the Authorization header of the requests to the exporter, if set
+	Auth Authorizer
+	// MaxStaleness is how old the cached metrics may be to still be served if the exporter can't be reached.
+	// If not set, the metrics are only served stale while Run is running.
+	MaxStaleness time.Duration
 
 	clock           func() time.Time
 	refreshInterval time.Duration
 	mutex           sync.Mutex
 	cache           []dto.MetricFamily
 	lastUpdated     time.Time
+	// lastErr is the error of the last refresh, if it failed
+	lastErr error
+	// background is set while Run keeps the cache up to date
+	background bool
+	// retrying is set while a failed refresh is retried in the background
+	retrying bool
 }
 
-func NewStaticFetcher(url string, authToken string, refreshInterval time.Duration, insecureSkipVerify bool) *StaticFetcher {
+func NewStaticFetcher(url string, auth Authorizer, refreshInterval time.Duration, insecureSkipVerify bool) *StaticFetcher {
 	return &StaticFetcher{
 		URL: url,
 		Client: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: insecureSkipVerify,
-				},
-			},
+			Transport: NewTransport(&tls.Config{
+				InsecureSkipVerify: insecureSkipVerify,
+			}),
 		},
 		refreshInterval: refreshInterval,
-		AuthToken:       authToken,
+		Auth:            auth,
 	}
 }
 
 // FetchMetrics will fetch and parse the exposed metrics of the configured exporter.
 // If a refreshInterval is set the method will cache the response, so if the method is called multiple times in the configured
 // refreshInterval interval, only the first call will result in a request to the upstream exporter.
-func (f *StaticFetcher) FetchMetrics(_ context.Context) ([]dto.MetricFamily, error) {
+// While Run is running, the last successfully fetched metrics are returned without querying the upstream exporter.
+//
+// If the exporter can't be reached, the last successfully fetched metrics are returned together with a *StaleError,
+// as long as they are not older than MaxStaleness. The fetch is then retried in the background.
+func (f *StaticFetcher) FetchMetrics(ctx context.Context) ([]dto.MetricFamily, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	if f.background && !f.lastUpdated.IsZero() {
+		return f.cached()
+	}
 	if f.now().Sub(f.lastUpdated) < f.refreshInterval {
 		return f.cache, nil
 	}
+	if f.retrying {
+		// Don't block on the upstream exporter while it's being retried
+		return f.cached()
+	}
 
-	metrics, err := fetchMetrics(f.Client, f.URL, f.AuthToken)
+	metrics, err := fetchMetrics(ctx, f.Client, f.URL, f.Auth)
 	if err != nil {
-		return nil, err
+		if f.MaxStaleness <= 0 || f.lastUpdated.IsZero() || f.now().Sub(f.lastUpdated) > f.MaxStaleness {
+			return nil, err
+		}
+		f.lastErr = err
+		f.retrying = true
+		go f.retry()
+		return f.cached()
 	}
 
 	f.cache = metrics
 	f.lastUpdated = f.now()
+	f.lastErr = nil
 	return metrics, nil
 }
 
+// cached returns the cached metrics.
+// If the last refresh failed, they are returned together with a *StaleError, or not at all if they are older than MaxStaleness.
+func (f *StaticFetcher) cached() ([]dto.MetricFamily, error) {
+	if f.lastErr == nil {
+		return f.cache, nil
+	}
+	if f.MaxStaleness > 0 && f.now().Sub(f.lastUpdated) > f.MaxStaleness {
+		return nil, f.lastErr
+	}
+	return f.cache, &StaleError{
+		Err:         f.lastErr,
+		LastUpdated: f.lastUpdated,
+	}
+}
+
+// Run refreshes the cached metrics every refreshInterval until ctx is canceled.
+// While it runs, FetchMetrics does not block on the upstream exporter.
+func (f *StaticFetcher) Run(ctx context.Context) {
+	f.mutex.Lock()
+	f.background = true
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		f.background = false
+		f.mutex.Unlock()
+	}()
+
+	refreshLoop(ctx, f.refreshInterval, f.refresh)
+}
+
+func (f *StaticFetcher) retry() {
+	ctx, cancel := context.WithTimeout(context.Background(), staleRetryTimeout)
+	defer cancel()
+	if err := f.refresh(ctx); err != nil {
+		log.Printf("Failed to refresh stale metrics of %s: %s", f.URL, err.Error())
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.retrying = false
+}
+
+func (f *StaticFetcher) refresh(ctx context.Context) error {
+	metrics, err := fetchMetrics(ctx, f.Client, f.URL, f.Auth)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err != nil {
+		f.lastErr = err
+		return err
+	}
+	f.cache = metrics
+	f.lastUpdated = f.now()
+	f.lastErr = nil
+	return nil
+}
+
 func (*StaticFetcher) FetchTargetConfigs(ctx context.Context, baseTarget string, basePath string) ([]StaticConfig, error) {
 
 	conf := StaticConfig{
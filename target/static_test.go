@@ -1,14 +1,18 @@
 package target
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -63,7 +67,7 @@ func TestFetchAuth(t *testing.T) {
 	}))
 	defer server.Close()
 
-	f := NewStaticFetcher(server.URL, "foobar", time.Second, false)
+	f := NewStaticFetcher(server.URL, StaticAuthorization("foobar"), time.Second, false)
 	f.Client = server.Client()
 
 	metrics, err := f.FetchMetrics(context.TODO())
@@ -71,6 +75,103 @@ func TestFetchAuth(t *testing.T) {
 	assert.Len(t, metrics, 2)
 }
 
+type rotatingAuthorizer struct {
+	tokens []string
+}
+
+func (a *rotatingAuthorizer) Authorization() (string, error) {
+	return a.tokens[0], nil
+}
+
+func (a *rotatingAuthorizer) Invalidate() {
+	a.tokens = a.tokens[1:]
+}
+
+func TestFetchAuth_Invalidate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "new" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		data, err := os.ReadFile("../testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	f := NewStaticFetcher(server.URL, &rotatingAuthorizer{tokens: []string{"expired", "new"}}, 0, false)
+	f.Client = server.Client()
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err, "rejected credentials are refreshed")
+	assert.Len(t, metrics, 2)
+
+	f = NewStaticFetcher(server.URL, &rotatingAuthorizer{tokens: []string{"expired", "invalid", "new"}}, 0, false)
+	f.Client = server.Client()
+	_, err = f.FetchMetrics(context.TODO())
+	require.Error(t, err, "requests are only retried once")
+}
+
+func TestFetchProtobuf(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		format := expfmt.Negotiate(req.Header)
+		require.Equal(t, expfmt.FmtProtoDelim, format, "protobuf should be preferred")
+
+		data, err := os.Open("../testdata/simple")
+		require.NoError(t, err)
+		defer data.Close()
+		metrics, err := decodeMetrics(data, expfmt.FmtText)
+		require.NoError(t, err)
+
+		rw.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(rw, format)
+		for i := range metrics {
+			require.NoError(t, enc.Encode(&metrics[i]))
+		}
+	}))
+	defer server.Close()
+
+	f := StaticFetcher{
+		URL:    server.URL,
+		Client: server.Client(),
+	}
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	mfs := map[string]*dto.MetricFamily{}
+	for i, mf := range metrics {
+		mfs[mf.GetName()] = &metrics[i]
+	}
+	assert.Contains(t, mfs, "test_metric_one")
+	assert.Len(t, mfs["test_metric_one"].GetMetric(), 3)
+	assert.Contains(t, mfs, "test_metric_two")
+	assert.EqualValues(t, 3, mfs["test_metric_two"].GetMetric()[2].Counter.GetValue())
+}
+
+func TestFetchGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.Contains(t, req.Header.Get("Accept-Encoding"), "gzip", "compression should be requested")
+
+		data, err := os.ReadFile("../testdata/simple")
+		require.NoError(t, err)
+		rw.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(rw)
+		defer gz.Close()
+		_, err = gz.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	f := NewStaticFetcher(server.URL, nil, 0, false)
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+}
+
 func TestFetchCache(t *testing.T) {
 	callCount := 0
 	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -118,6 +219,108 @@ func TestFetchCache(t *testing.T) {
 	assert.Equal(t, 2, callCount)
 }
 
+func TestFetchBackground(t *testing.T) {
+	var callCount int32
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&callCount, 1) > 1 {
+			// Simulate a slow exporter
+			select {
+			case <-block:
+			case <-req.Context().Done():
+			}
+		}
+		data, err := os.ReadFile("../testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+	defer close(block)
+
+	f := NewStaticFetcher(server.URL, nil, 10*time.Millisecond, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&callCount) > 1
+	}, time.Second, time.Millisecond, "metrics should be refreshed in the background")
+
+	// The upstream exporter is blocked, but the last snapshot is served immediately
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background refresh did not stop")
+	}
+}
+
+func TestFetchStale(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, err := os.ReadFile("../testdata/simple")
+		require.NoError(t, err)
+		_, err = rw.Write(data)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	fakeNow := &time.Time{}
+	*fakeNow = time.Now()
+	fakeClock := func() time.Time {
+		return *fakeNow
+	}
+	f := StaticFetcher{
+		URL:          server.URL,
+		Client:       server.Client(),
+		MaxStaleness: time.Minute,
+		clock:        fakeClock,
+	}
+	retrying := func() bool {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return f.retrying
+	}
+
+	metrics, err := f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	lastUpdated := *fakeNow
+
+	atomic.StoreInt32(&failing, 1)
+	*fakeNow = fakeNow.Add(30 * time.Second)
+	metrics, err = f.FetchMetrics(context.TODO())
+	stale := &StaleError{}
+	require.ErrorAs(t, err, &stale)
+	assert.Equal(t, lastUpdated, stale.LastUpdated)
+	assert.Len(t, metrics, 2, "should serve the cached metrics")
+	require.Eventually(t, func() bool { return !retrying() }, time.Second, time.Millisecond, "should retry in the background")
+
+	*fakeNow = fakeNow.Add(time.Minute)
+	metrics, err = f.FetchMetrics(context.TODO())
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &stale), "should not serve metrics older than the max staleness")
+	assert.Nil(t, metrics)
+
+	atomic.StoreInt32(&failing, 0)
+	metrics, err = f.FetchMetrics(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+}
+
 func TestFetchError(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.WriteHeader(418)
@@ -126,7 +329,7 @@ func TestFetchError(t *testing.T) {
 	}))
 	defer server.Close()
 
-	f := NewStaticFetcher(server.URL, "", time.Second, false)
+	f := NewStaticFetcher(server.URL, nil, time.Second, false)
 	f.Client = server.Client()
 
 	_, err := f.FetchMetrics(context.TODO())
@@ -135,7 +338,7 @@ func TestFetchError(t *testing.T) {
 
 func TestFetchTargetConfigs(t *testing.T) {
 
-	f := NewStaticFetcher("http://foobar.example.com/buzz", "", time.Second, false)
+	f := NewStaticFetcher("http://foobar.example.com/buzz", nil, time.Second, false)
 
 	tconfs, err := f.FetchTargetConfigs(context.TODO(), "proxy.example.com", "/buzz")
 	require.NoError(t, err)
@@ -1,9 +1,13 @@
 package target
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
@@ -15,19 +19,49 @@ type StaticConfig struct {
 	Labels  model.LabelSet `json:"labels"`
 }
 
-func fetchMetrics(client *http.Client, url string, authToken string) ([]dto.MetricFamily, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-	if authToken != "" {
-		req.Header.Add("Authorization", authToken)
+// Authorizer provides the value of the Authorization header of the requests to an exporter.
+type Authorizer interface {
+	Authorization() (string, error)
+}
+
+// StaticAuthorization is an Authorizer that always uses the same value.
+type StaticAuthorization string
+
+func (a StaticAuthorization) Authorization() (string, error) {
+	return string(a), nil
+}
+
+// NewTransport returns the transport of the requests to exporters with the given TLS configuration.
+// Exporters are always requested directly, the proxy environment variables are ignored.
+func NewTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: tlsConfig,
 	}
+}
+
+const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,*/*;q=0.1`
+
+// Invalidator is implemented by Authorizers that cache their credentials.
+// Invalidate is called if the credentials are rejected, so that the next call to Authorization gets fresh ones.
+type Invalidator interface {
+	Invalidate()
+}
 
-	resp, err := client.Do(req)
+// fetchMetrics fetches and decodes the metrics at url. If auth is set, it provides the Authorization header.
+// If the request is rejected as unauthorized and auth is an Invalidator, it is retried once with fresh credentials.
+func fetchMetrics(ctx context.Context, client *http.Client, url string, auth Authorizer) ([]dto.MetricFamily, error) {
+	resp, err := requestMetrics(ctx, client, url, auth)
 	if err != nil {
 		return nil, err
 	}
+	if inv, ok := auth.(Invalidator); ok && resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		inv.Invalidate()
+		resp, err = requestMetrics(ctx, client, url, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 300 {
@@ -42,6 +76,28 @@ func fetchMetrics(client *http.Client, url string, authToken string) ([]dto.Metr
 	return decodeMetrics(resp.Body, expfmt.ResponseFormat(resp.Header))
 }
 
+func requestMetrics(ctx context.Context, client *http.Client, url string, auth Authorizer) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		authorization, err := auth.Authorization()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get credentials: %w", err)
+		}
+		if authorization != "" {
+			req.Header.Add("Authorization", authorization)
+		}
+	}
+	// Prefer protobuf, as it is the only format that we can decode that supports native histograms and exemplars
+	req.Header.Set("Accept", acceptHeader)
+	// We don't set the Accept-Encoding header, so that the http.Transport requests a gzip compressed response and
+	// transparently decompresses it.
+
+	return client.Do(req)
+}
+
 func decodeMetrics(r io.Reader, format expfmt.Format) ([]dto.MetricFamily, error) {
 	dec := expfmt.NewDecoder(r, format)
 	metrics := []dto.MetricFamily{}
@@ -58,3 +114,19 @@ func decodeMetrics(r io.Reader, format expfmt.Format) ([]dto.MetricFamily, error
 		metrics = append(metrics, mf)
 	}
 }
+
+// refreshLoop calls refresh immediately and then every interval until ctx is canceled.
+func refreshLoop(ctx context.Context, interval time.Duration, refresh func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to refresh metrics: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
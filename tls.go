@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vshn/exporter-filterproxy/target"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsFileCheckInterval limits how often the TLS files are checked for changes, as they would otherwise be checked for
+// every handshake or request.
+const tlsFileCheckInterval = time.Second
+
+// serverNextProtos are the protocols the server negotiates with ALPN, which are the defaults of http.Server.
+// They need to be set on the config returned by GetConfigForClient, as it replaces the config of the server.
+var serverNextProtos = []string{"h2", "http/1.1"}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// serverTLS provides the TLS configuration of the server.
+// The certificate and the client CA are reloaded whenever one of the files changes.
+type serverTLS struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	clock     func() time.Time
+	mutex     sync.Mutex
+	checkedAt time.Time
+	versions  map[string]fileVersion
+	config    *tls.Config
+}
+
+func newServerTLS(conf tlsServerConfig) (*serverTLS, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, errors.New("cert_file and key_file need to be set")
+	}
+	clientAuth := tls.NoClientCert
+	if conf.ClientCAFile != "" {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if conf.ClientAuthType != "" {
+		ca, ok := clientAuthTypes[conf.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("invalid client_auth_type %q", conf.ClientAuthType)
+		}
+		clientAuth = ca
+	}
+	if clientAuth >= tls.VerifyClientCertIfGiven && conf.ClientCAFile == "" {
+		return nil, fmt.Errorf("client_auth_type %q requires client_ca_file to be set", conf.ClientAuthType)
+	}
+
+	s := &serverTLS{
+		certFile:     conf.CertFile,
+		keyFile:      conf.KeyFile,
+		clientCAFile: conf.ClientCAFile,
+		clientAuth:   clientAuth,
+	}
+	// Load the files once, to fail early if they are invalid
+	if _, err := s.getConfig(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TLSConfig returns a tls.Config that always uses the current version of the certificate and client CA.
+func (s *serverTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: serverNextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.getConfig()
+		},
+		// Only used if the config is not replaced by GetConfigForClient, but http.Server requires a certificate to be set
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, err := s.getConfig()
+			if err != nil {
+				return nil, err
+			}
+			return &c.Certificates[0], nil
+		},
+	}
+}
+
+func (s *serverTLS) getConfig() (*tls.Config, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	if s.config != nil && now.Sub(s.checkedAt) < tlsFileCheckInterval {
+		return s.config, nil
+	}
+	s.checkedAt = now
+	versions, err := statFiles(s.certFile, s.keyFile, s.clientCAFile)
+	if err != nil {
+		if s.config != nil {
+			log.Printf("Failed to check TLS files, using previous configuration: %s", err.Error())
+			return s.config, nil
+		}
+		return nil, err
+	}
+	if s.config != nil && versionsEqual(s.versions, versions) {
+		return s.config, nil
+	}
+
+	config, err := s.load()
+	if err != nil {
+		if s.config != nil {
+			log.Printf("Failed to reload TLS files, using previous configuration: %s", err.Error())
+			return s.config, nil
+		}
+		return nil, err
+	}
+	if s.config != nil {
+		log.Println("Reloaded TLS configuration")
+	}
+	s.config = config
+	s.versions = versions
+	return s.config, nil
+}
+
+func (s *serverTLS) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   serverNextProtos,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   s.clientAuth,
+	}
+	if s.clientCAFile != "" {
+		pem, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", s.clientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+func (s *serverTLS) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
+
+// clientTLS is the transport of the requests to an exporter that uses a tls_config.
+// A new http.Transport is used whenever the CA, the certificate, or the key changes.
+type clientTLS struct {
+	caFile             string
+	certFile           string
+	keyFile            string
+	serverName         string
+	minVersion         uint16
+	insecureSkipVerify bool
+
+	clock     func() time.Time
+	mutex     sync.Mutex
+	checkedAt time.Time
+	versions  map[string]fileVersion
+	transport *http.Transport
+}
+
+func newClientTLS(conf tlsClientConfig, insecureSkipVerify bool) (*clientTLS, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file need to be set together")
+	}
+	minVersion := uint16(tls.VersionTLS12)
+	if conf.MinVersion != "" {
+		v, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid min_version %q", conf.MinVersion)
+		}
+		minVersion = v
+	}
+
+	c := &clientTLS{
+		caFile:             conf.CAFile,
+		certFile:           conf.CertFile,
+		keyFile:            conf.KeyFile,
+		serverName:         conf.ServerName,
+		minVersion:         minVersion,
+		insecureSkipVerify: insecureSkipVerify,
+	}
+	// Load the files once, to fail early if they are invalid
+	if _, err := c.getTransport(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *clientTLS) RoundTrip(req *http.Request) (*http.Response, error) {
+	t, err := c.getTransport()
+	if err != nil {
+		return nil, err
+	}
+	return t.RoundTrip(req)
+}
+
+func (c *clientTLS) getTransport() (*http.Transport, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	if c.transport != nil && now.Sub(c.checkedAt) < tlsFileCheckInterval {
+		return c.transport, nil
+	}
+	c.checkedAt = now
+	versions, err := statFiles(c.caFile, c.certFile, c.keyFile)
+	if err != nil {
+		if c.transport != nil {
+			log.Printf("Failed to check TLS files, using previous configuration: %s", err.Error())
+			return c.transport, nil
+		}
+		return nil, err
+	}
+	if c.transport != nil && versionsEqual(c.versions, versions) {
+		return c.transport, nil
+	}
+
+	config, err := c.load()
+	if err != nil {
+		if c.transport != nil {
+			log.Printf("Failed to reload TLS files, using previous configuration: %s", err.Error())
+			return c.transport, nil
+		}
+		return nil, err
+	}
+	if c.transport != nil {
+		log.Println("Reloaded TLS client configuration")
+		// Connections that are in use are closed once their requests are done
+		c.transport.CloseIdleConnections()
+	}
+	c.transport = target.NewTransport(config)
+	c.versions = versions
+	return c.transport, nil
+}
+
+func (c *clientTLS) load() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         c.minVersion,
+		ServerName:         c.serverName,
+		InsecureSkipVerify: c.insecureSkipVerify,
+	}
+	if c.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", c.caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (c *clientTLS) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// fileVersion identifies the version of a file by its modification time and size.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(paths ...string) (map[string]fileVersion, error) {
+	versions := map[string]fileVersion{}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		versions[p] = fileVersion{
+			modTime: fi.ModTime(),
+			size:    fi.Size(),
+		}
+	}
+	return versions, nil
+}
+
+func versionsEqual(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || !bv.modTime.Equal(v.modTime) || bv.size != v.size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerTLS_ClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	otherCA := newTestCA(t, "other-ca")
+	writeTestServerCerts(t, dir, ca)
+
+	st, err := newServerTLS(tlsServerConfig{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		ClientCAFile:   filepath.Join(dir, "ca.crt"),
+		ClientAuthType: "VerifyClientCertIfGiven",
+	})
+	require.NoError(t, err)
+	auth, err := newCertAuthenticator(certSourceCN, "namespace")
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(authenticate("test", auth, multiHandler("/test", testMultiMetricsFetcher, nil)))
+	server.TLS = st.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	tcs := map[string]struct {
+		cert *tls.Certificate
+
+		code int
+		body string
+	}{
+		"NoCert": {
+			code: http.StatusUnauthorized,
+		},
+		"Valid": {
+			cert: ca.issue(t, "b"),
+			code: http.StatusOK,
+			body: expectedKubeAuthB,
+		},
+		"NoCN": {
+			cert: ca.issue(t, ""),
+			code: http.StatusForbidden,
+		},
+	}
+	for name, tc := range tcs {
+		t.Run(name, func(t *testing.T) {
+			client := newTestTLSClient(ca, tc.cert)
+			resp, err := client.Get(server.URL + "/test/ns")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.code, resp.StatusCode)
+			if tc.body != "" {
+				assert.Equal(t, tc.body, readBody(t, resp))
+			}
+		})
+	}
+
+	t.Run("UnknownCA", func(t *testing.T) {
+		client := newTestTLSClient(ca, otherCA.issue(t, "b"))
+		_, err := client.Get(server.URL + "/test/ns")
+		require.Error(t, err)
+	})
+}
+
+func TestServerTLS_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	writeTestServerCerts(t, dir, ca)
+
+	st, err := newServerTLS(tlsServerConfig{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	})
+	require.NoError(t, err)
+	fakeNow := time.Now()
+	st.clock = func() time.Time {
+		return fakeNow
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.TLS = st.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := newTestTLSClient(ca, ca.issue(t, "b")).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	rotatedCA := newTestCA(t, "rotated-ca")
+	writeTestServerCerts(t, dir, rotatedCA)
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{"tls.crt", "tls.key", "ca.crt"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, f), future, future))
+	}
+
+	// The files are only checked every tlsFileCheckInterval
+	_, err = newTestTLSClient(ca, ca.issue(t, "b")).Get(server.URL)
+	require.NoError(t, err)
+	fakeNow = fakeNow.Add(tlsFileCheckInterval)
+
+	_, err = newTestTLSClient(ca, ca.issue(t, "b")).Get(server.URL)
+	require.Error(t, err, "the old CA should no longer be trusted")
+
+	resp, err = newTestTLSClient(rotatedCA, rotatedCA.issue(t, "b")).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Broken files are ignored and the previous configuration is kept
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), []byte("broken"), 0o600))
+	fakeNow = fakeNow.Add(tlsFileCheckInterval)
+	resp, err = newTestTLSClient(rotatedCA, rotatedCA.issue(t, "b")).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestServerTLS_HTTP2(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	writeTestServerCerts(t, dir, ca)
+
+	st, err := newServerTLS(tlsServerConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+	})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}),
+		TLSConfig: st.TLSConfig(),
+	}
+	go server.ServeTLS(l, "", "")
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Get("https://" + l.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 2, resp.ProtoMajor, "HTTP/2 should be negotiated")
+}
+
+func TestNewServerTLS_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	writeTestServerCerts(t, dir, ca)
+
+	_, err := newServerTLS(tlsServerConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+	})
+	assert.Error(t, err)
+
+	_, err = newServerTLS(tlsServerConfig{
+		CertFile:       filepath.Join(dir, "tls.crt"),
+		KeyFile:        filepath.Join(dir, "tls.key"),
+		ClientAuthType: "RequireAndVerifyClientCert",
+	})
+	assert.Error(t, err)
+
+	_, err = newServerTLS(tlsServerConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "missing.key"),
+	})
+	assert.Error(t, err)
+}
+
+func TestClientTLS(t *testing.T) {
+	serverDir := t.TempDir()
+	clientDir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	writeTestServerCerts(t, serverDir, ca)
+	writeTestServerCerts(t, clientDir, ca)
+
+	st, err := newServerTLS(tlsServerConfig{
+		CertFile:     filepath.Join(serverDir, "tls.crt"),
+		KeyFile:      filepath.Join(serverDir, "tls.key"),
+		ClientCAFile: filepath.Join(serverDir, "ca.crt"),
+	})
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.TLS = st.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	conf := tlsClientConfig{
+		CAFile:   filepath.Join(clientDir, "ca.crt"),
+		CertFile: filepath.Join(clientDir, "tls.crt"),
+		KeyFile:  filepath.Join(clientDir, "tls.key"),
+	}
+	ct, err := newClientTLS(conf, false)
+	require.NoError(t, err)
+	fakeNow := time.Now()
+	ct.clock = func() time.Time {
+		return fakeNow
+	}
+	st.clock = ct.clock
+	client := &http.Client{Transport: ct}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Nil(t, ct.transport.Proxy, "exporters are requested directly, like without a tls_config")
+
+	t.Run("NoClientCert", func(t *testing.T) {
+		ct, err := newClientTLS(tlsClientConfig{CAFile: conf.CAFile}, false)
+		require.NoError(t, err)
+		_, err = (&http.Client{Transport: ct}).Get(server.URL)
+		require.Error(t, err)
+	})
+	t.Run("ServerName", func(t *testing.T) {
+		ct, err := newClientTLS(tlsClientConfig{CAFile: conf.CAFile, CertFile: conf.CertFile, KeyFile: conf.KeyFile, ServerName: "other.example.com"}, false)
+		require.NoError(t, err)
+		_, err = (&http.Client{Transport: ct}).Get(server.URL)
+		require.Error(t, err, "the certificate of the server is not valid for other.example.com")
+	})
+
+	// Rotate the certificates of the server and the client
+	rotatedCA := newTestCA(t, "rotated-ca")
+	writeTestServerCerts(t, serverDir, rotatedCA)
+	writeTestServerCerts(t, clientDir, rotatedCA)
+	future := time.Now().Add(time.Minute)
+	for _, dir := range []string{serverDir, clientDir} {
+		for _, f := range []string{"tls.crt", "tls.key", "ca.crt"} {
+			require.NoError(t, os.Chtimes(filepath.Join(dir, f), future, future))
+		}
+	}
+	previous := ct.transport
+	transport, err := ct.getTransport()
+	require.NoError(t, err)
+	assert.Same(t, previous, transport, "the files should only be checked once per tlsFileCheckInterval")
+
+	fakeNow = fakeNow.Add(tlsFileCheckInterval)
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err, "the rotated certificates should be used")
+	resp.Body.Close()
+}
+
+func TestNewClientTLS_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	writeTestServerCerts(t, dir, ca)
+
+	_, err := newClientTLS(tlsClientConfig{CertFile: filepath.Join(dir, "tls.crt")}, false)
+	assert.Error(t, err)
+
+	_, err = newClientTLS(tlsClientConfig{MinVersion: "SSL3"}, false)
+	assert.Error(t, err)
+
+	_, err = newClientTLS(tlsClientConfig{CAFile: filepath.Join(dir, "tls.key")}, false)
+	assert.Error(t, err, "the key is not a CA certificate")
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, cn string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate signed by the CA that is valid for client and server authentication on localhost.
+func (ca testCA) issue(t *testing.T, cn string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+func writeTestServerCerts(t *testing.T, dir string, ca testCA) {
+	cert := ca.issue(t, "server")
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+}
+
+func newTestTLSClient(ca testCA, cert *tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	conf := &tls.Config{
+		RootCAs: pool,
+	}
+	if cert != nil {
+		// Always send the certificate, even if it is not signed by one of the CAs accepted by the server
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   conf,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	b := new(strings.Builder)
+	_, err := io.Copy(b, resp.Body)
+	require.NoError(t, err)
+	return b.String()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/vshn/exporter-filterproxy/target"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// configErrors lists all problems found in a configuration.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// validate checks the configuration for semantic errors and returns all of them as configErrors.
+// It does not check anything that requires access to files, the network, or the Kubernetes API.
+func (c config) validate() error {
+	errs := configErrors{}
+	add := func(prefix string, problems []string) {
+		for _, p := range problems {
+			errs = append(errs, prefix+p)
+		}
+	}
+
+	if c.Addr == "" {
+		errs = append(errs, "addr: needs to be set")
+	}
+
+	// patterns are the paths registered on the mux, which panics on duplicates
+	patterns := map[string]string{
+		"/":               "the service discovery of all endpoints",
+		reloadMetricsPath: "the reload metrics",
+	}
+	for _, name := range sortedKeys(c.Endpoints) {
+		endpoint := c.Endpoints[name]
+		prefix := fmt.Sprintf("endpoints.%s: ", name)
+		add(prefix, endpoint.validate())
+
+		paths := []string{endpoint.Path}
+		if endpoint.KubernetesTarget != nil {
+			paths = append(paths, endpoint.Path+"/")
+		}
+		for _, p := range paths {
+			if other, ok := patterns[p]; ok && endpoint.Path != "" {
+				errs = append(errs, fmt.Sprintf("%spath %q conflicts with %s", prefix, p, other))
+				continue
+			}
+			patterns[p] = fmt.Sprintf("endpoint %q", name)
+		}
+	}
+
+	tokens := map[string]bool{}
+	for _, name := range sortedKeys(c.Tenants) {
+		tenant := c.Tenants[name]
+		prefix := fmt.Sprintf("tenants.%s: ", name)
+		if tenant.Token == "" {
+			errs = append(errs, prefix+"token needs to be set")
+		} else if tokens[tenant.Token] {
+			errs = append(errs, prefix+"token is used by another tenant")
+		}
+		tokens[tenant.Token] = true
+		if _, err := parseEnforcedLabels(tenant.EnforcedLabels); err != nil {
+			errs = append(errs, prefix+err.Error())
+		}
+		for _, e := range tenant.Endpoints {
+			if _, ok := c.Endpoints[e]; !ok {
+				errs = append(errs, fmt.Sprintf("%sunknown endpoint %q", prefix, e))
+			}
+		}
+	}
+
+	if c.KubernetesAuth != nil && c.KubernetesAuth.CacheTTL < 0 {
+		errs = append(errs, "kubernetes_auth.cache_ttl: must not be negative")
+	}
+	if c.JWTAuth != nil {
+		add("jwt_auth: ", c.JWTAuth.validate())
+	}
+	if c.TLSServerConfig != nil {
+		add("tls_server_config: ", c.TLSServerConfig.validate())
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (c endpointConfig) validate() []string {
+	errs := []string{}
+	if !strings.HasPrefix(c.Path, "/") {
+		errs = append(errs, "path needs to start with `/`")
+	}
+	if c.RefreshInterval < 0 {
+		errs = append(errs, "refresh_interval must not be negative")
+	}
+	if c.MaxStaleness < 0 {
+		errs = append(errs, "max_staleness must not be negative")
+	}
+	if c.BackgroundRefresh && c.RefreshInterval <= 0 {
+		errs = append(errs, "background_refresh requires refresh_interval to be set")
+	}
+	if _, err := c.enforcedMatchers(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	switch c.Auth.Type {
+	case authModeNone, authModeKube:
+	case authModeBearer:
+		if (c.Auth.Token == "") == (c.Auth.TokenFile == "") {
+			errs = append(errs, "exactly one of auth.token or auth.token_file needs to be set for auth type Bearer")
+		}
+	case authModeBasic:
+		if c.Auth.Username == "" {
+			errs = append(errs, "auth.username needs to be set for auth type Basic")
+		}
+		if c.Auth.Password != "" && c.Auth.PasswordFile != "" {
+			errs = append(errs, "only one of auth.password or auth.password_file can be set")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("auth.type %q is unknown, must be %q, %q, or %q", c.Auth.Type, authModeBearer, authModeBasic, authModeKube))
+	}
+
+	if c.TLSConfig != nil {
+		for _, e := range c.TLSConfig.validate() {
+			errs = append(errs, "tls_config."+e)
+		}
+	}
+
+	switch {
+	case c.Target != "" && c.KubernetesTarget != nil:
+		errs = append(errs, "only one of target and kubernetes_target can be set")
+	case c.Target != "":
+		u, err := url.Parse(c.Target)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("target is invalid: %s", err.Error()))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("target %q needs to be an http or https URL", c.Target))
+		}
+	case c.KubernetesTarget != nil:
+		if strings.HasSuffix(c.Path, "/") {
+			errs = append(errs, "path of a kubernetes_target must not end with `/`")
+		}
+		errs = append(errs, c.KubernetesTarget.validate()...)
+	default:
+		errs = append(errs, "either target or kubernetes_target needs to be set")
+	}
+	return errs
+}
+
+func (c kubeTarget) validate() []string {
+	errs := []string{}
+	if c.AggregatePodLabel != "" {
+		if !c.Aggregate {
+			errs = append(errs, "kubernetes_target.aggregate_pod_label requires kubernetes_target.aggregate to be set")
+		}
+		if !model.LabelName(c.AggregatePodLabel).IsValid() || c.AggregatePodLabel == "instance" {
+			errs = append(errs, fmt.Sprintf("kubernetes_target.aggregate_pod_label %q is not a valid label name other than `instance`", c.AggregatePodLabel))
+		}
+	}
+
+	if c.Pods != nil {
+		if c.Endpoint.Name != "" || c.Endpoint.Selector != "" {
+			errs = append(errs, "kubernetes_target.endpoint can't be set together with kubernetes_target.pods")
+		}
+		for _, e := range c.Pods.validate() {
+			errs = append(errs, "kubernetes_target.pods."+e)
+		}
+		return errs
+	}
+
+	for _, e := range c.Endpoint.validate() {
+		errs = append(errs, "kubernetes_target.endpoint."+e)
+	}
+	return errs
+}
+
+func (c kubeEndpointTarget) validate() []string {
+	errs := []string{}
+	switch {
+	case c.Name == "" && c.Selector == "":
+		errs = append(errs, "name or selector needs to be set")
+	case c.Name != "" && c.Selector != "":
+		errs = append(errs, "name and selector can't be set at the same time")
+	case c.Name != "" && (len(c.Namespaces) > 0 || c.NamespaceSelector != ""):
+		errs = append(errs, "namespaces and namespace_selector can only be used with selector")
+	case c.Name != "" && c.Namespace == "":
+		errs = append(errs, "namespace needs to be set if name is set")
+	}
+	if c.Selector != "" {
+		if _, err := labels.Parse(c.Selector); err != nil {
+			errs = append(errs, fmt.Sprintf("selector is invalid: %s", err.Error()))
+		}
+	}
+	if c.NamespaceSelector != "" {
+		if c.Namespace != "" || len(c.Namespaces) > 0 {
+			errs = append(errs, "namespace_selector can't be combined with namespace and namespaces")
+		}
+		if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+			errs = append(errs, fmt.Sprintf("namespace_selector is invalid: %s", err.Error()))
+		}
+	}
+	switch c.Discovery {
+	case "", target.DiscoveryEndpoints, target.DiscoveryEndpointSlices:
+	default:
+		errs = append(errs, fmt.Sprintf("discovery %q is unknown, must be %q or %q", c.Discovery, target.DiscoveryEndpoints, target.DiscoveryEndpointSlices))
+	}
+	return append(errs, validateScrape(c.Port, c.Scheme)...)
+}
+
+func (c kubePodsTarget) validate() []string {
+	errs := []string{}
+	if c.Selector == "" {
+		errs = append(errs, "selector needs to be set")
+	} else if _, err := labels.Parse(c.Selector); err != nil {
+		errs = append(errs, fmt.Sprintf("selector is invalid: %s", err.Error()))
+	}
+	return append(errs, validateScrape(c.Port, c.Scheme)...)
+}
+
+// validateScrape validates how the discovered Kubernetes targets are scraped.
+func validateScrape(port string, scheme string) []string {
+	errs := []string{}
+	if port == "" {
+		errs = append(errs, "port needs to be set")
+	}
+	if scheme != "http" && scheme != "https" {
+		errs = append(errs, fmt.Sprintf("scheme %q is invalid, must be `http` or `https`", scheme))
+	}
+	return errs
+}
+
+func (c jwtAuthConfig) validate() []string {
+	errs := []string{}
+	if (c.JWKSFile == "") == (c.JWKSURL == "") {
+		errs = append(errs, "exactly one of jwks_file or jwks_url needs to be set")
+	}
+	if c.Claim == "" || c.Label == "" {
+		errs = append(errs, "claim and label need to be set")
+	}
+	if c.Issuer == "" || c.Audience == "" {
+		errs = append(errs, "issuer and audience need to be set")
+	}
+	if c.JWKSRefreshInterval < 0 {
+		errs = append(errs, "jwks_refresh_interval must not be negative")
+	}
+	return errs
+}
+
+func (c tlsServerConfig) validate() []string {
+	errs := []string{}
+	if c.CertFile == "" || c.KeyFile == "" {
+		errs = append(errs, "cert_file and key_file need to be set")
+	}
+	if c.ClientAuthType != "" {
+		ca, ok := clientAuthTypes[c.ClientAuthType]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("client_auth_type %q is unknown", c.ClientAuthType))
+		} else if ca >= tls.VerifyClientCertIfGiven && c.ClientCAFile == "" {
+			errs = append(errs, fmt.Sprintf("client_auth_type %q requires client_ca_file to be set", c.ClientAuthType))
+		}
+	}
+	if c.TenantFrom != "" {
+		if c.TenantFrom != certSourceCN && c.TenantFrom != certSourceSAN {
+			errs = append(errs, fmt.Sprintf("tenant_from %q is unknown, must be %q or %q", c.TenantFrom, certSourceCN, certSourceSAN))
+		}
+		if c.TenantLabel == "" {
+			errs = append(errs, "tenant_label needs to be set if tenant_from is set")
+		}
+		if c.ClientCAFile == "" {
+			errs = append(errs, "tenant_from requires client_ca_file to be set")
+		}
+	}
+	return errs
+}
+
+func (c tlsClientConfig) validate() []string {
+	errs := []string{}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, "cert_file and key_file need to be set together")
+	}
+	if _, ok := tlsVersions[c.MinVersion]; c.MinVersion != "" && !ok {
+		errs = append(errs, fmt.Sprintf("min_version %q is unknown, must be one of %s", c.MinVersion, strings.Join(sortedKeys(tlsVersions), ", ")))
+	}
+	return errs
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}